@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/grafana/clusterurl/pkg/consts"
@@ -23,15 +24,45 @@ import (
 
 var (
 	performTraining bool
+	order           int
+	objective       string
+	target          float64
+	bundle          string
+	output          string
 )
 
 func main() {
 
 	flag.BoolVar(&performTraining, "train", false, "train")
+	flag.IntVar(&order, "order", 2, "length of the n-grams of the trained model")
+	flag.StringVar(&objective, "objective", "f1", "criterion picking the threshold: f1, midpoint, precision or recall")
+	flag.Float64Var(&target, "target", 0, "precision or recall to reach with the precision and recall objectives")
+	flag.StringVar(&bundle, "bundle", "", "comma-separated language=directory pairs to train a bundle from, each directory holding big.txt, good.txt and bad.txt")
+	flag.StringVar(&output, "output", "pkg/clusterurl/model.json", "file the trained model or bundle is written to")
 	flag.Parse()
 
+	if performTraining && bundle != "" {
+		languages := map[string]training.Options{}
+		for _, pair := range strings.Split(bundle, ",") {
+			language, dir, found := strings.Cut(pair, "=")
+			if !found || language == "" || dir == "" {
+				log.Fatalf("invalid bundle entry %q, expected language=directory", pair)
+			}
+			languages[language] = trainingOptions(dir)
+		}
+
+		err := training.TrainBundle(languages, output)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	if performTraining {
-		err := training.TrainModel(consts.AcceptedCharacters, "assets/big.txt", "assets/good.txt", "assets/bad.txt", "pkg/clusterurl/model.json")
+		options := trainingOptions("assets")
+		options.OutputFile = output
+		err := training.TrainModelWithOptions(options)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -40,7 +71,9 @@ func main() {
 	}
 
 	reader := bufio.NewReader(os.Stdin)
-	data, err := persistence.LoadKnowledgeBase("pkg/clusterurl/model.json")
+	// Single models are loaded as bundles of one model, so that the
+	// bundles written by -bundle can be checked too.
+	bundle, err := persistence.LoadBundle(output)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -50,9 +83,28 @@ func main() {
 		fmt.Print("Insert something to check: ")
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
-		isGibberish := gibberish.IsGibberish(input, data)
-		fmt.Println(fmt.Sprintf("Input: %s: is gibberish? %v\n", input, isGibberish))
+		language, score := gibberish.ScoreBundle(input, bundle)
+		if language != "" {
+			language = ", language " + language
+		}
+		fmt.Println(fmt.Sprintf("Input: %s: is gibberish? %v (probability %.4f, threshold %.4f, confidence %.2f%s)\n", input, score.Gibberish(), score.Probability, score.Threshold, score.Confidence, language))
+
+	}
+
+}
+
+// trainingOptions returns the options training a model from the
+// big.txt, good.txt and bad.txt files of the directory.
+func trainingOptions(dir string) training.Options {
 
+	return training.Options{
+		AcceptedChars: consts.AcceptedCharacters,
+		TrainingFile:  filepath.Join(dir, "big.txt"),
+		GoodFile:      filepath.Join(dir, "good.txt"),
+		BadFile:       filepath.Join(dir, "bad.txt"),
+		Order:         order,
+		Objective:     training.Objective(objective),
+		Target:        target,
 	}
 
 }
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"math"
 	"strings"
+	"unicode"
 
 	"github.com/grafana/clusterurl/pkg/consts"
 	"github.com/grafana/clusterurl/pkg/structs"
@@ -21,6 +22,11 @@ import (
 // AverageTransitionProbability returns the probability of
 // generating the input string digraph by digraph according
 // to the occurrences matrix.
+//
+// Deprecated: it normalizes the input with
+// consts.AcceptedCharacters, which is wrong for models with
+// their own alphabet, and ignores the contexts of n-gram
+// models. Use AverageNGramProbability instead.
 func AverageTransitionProbability(line string, occurrences [][]float64, position map[rune]int) (float64, error) {
 
 	logProb := 0.0
@@ -51,11 +57,145 @@ func AverageTransitionProbability(line string, occurrences [][]float64, position
 
 }
 
+// AverageNGramProbability returns the probability of
+// generating the input string rune by rune according to the
+// model, along with the number of transitions it scored. The
+// input is lowercased, and the runes missing from the
+// alphabet of the model are ignored. Each rune is scored in
+// the longest context of up to Order-1 preceding runes known
+// by the model, backing off to the digraphs. For bigram
+// models using the default alphabet, it returns the same
+// probability as AverageTransitionProbability.
+func AverageNGramProbability(line string, data *structs.GibberishData) (float64, int, error) {
+
+	logProb, transitions, err := nGramLogProbability(line, data, nil)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	return math.Exp(logProb / math.Max(float64(transitions), 1)), transitions, nil
+
+}
+
+// NGramLogProbabilities returns the log probability of each
+// transition of the input string according to the model, in
+// the order AverageNGramProbability scores them.
+func NGramLogProbabilities(line string, data *structs.GibberishData) ([]float64, error) {
+
+	logProbs := []float64{}
+	_, _, err := nGramLogProbability(line, data, &logProbs)
+	if err != nil {
+		return nil, err
+	}
+
+	return logProbs, nil
+
+}
+
+// nGramLogProbability returns the sum of the log
+// probabilities of the transitions of the input string and
+// their number. When logProbs is not nil, each log
+// probability is appended to it.
+func nGramLogProbability(line string, data *structs.GibberishData, logProbs *[]float64) (float64, int, error) {
+
+	logProb := 0.0
+	transitions := 0
+
+	// Bigram models are scored in a single pass over the
+	// input, without normalizing it first, since they are on
+	// the hot path of the URL classifier.
+	order := data.NGramOrder()
+	if order == 2 || len(data.Contexts) == 0 {
+
+		previous := -1
+		for _, r := range line {
+
+			position, found := data.Positions[unicode.ToLower(r)]
+			if !found {
+				continue
+			}
+
+			if previous >= 0 {
+				transition := data.Occurrences[previous][position]
+				logProb += transition
+				transitions++
+				if logProbs != nil {
+					*logProbs = append(*logProbs, transition)
+				}
+			}
+			previous = position
+
+		}
+
+		return logProb, transitions, nil
+
+	}
+
+	runes := NormalizeAlphabet(line, data.AcceptedCharacters())
+
+	// offsets holds the index of each rune in normalized,
+	// followed by the length of normalized, so that contexts
+	// can be looked up without allocating.
+	normalized := string(runes)
+	offsets := make([]int, 0, len(runes)+1)
+	for offset := range normalized {
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets, len(normalized))
+
+	for i := 1; i < len(runes); i++ {
+
+		position, found := data.Positions[runes[i]]
+		if !found {
+			return -1, 0, fmt.Errorf("AverageNGramProbability: unable to find the position of the rune %s", string(runes[i]))
+		}
+
+		var row []float64
+		length := order - 1
+		if length > i {
+			length = i
+		}
+		for ; length >= 2 && row == nil; length-- {
+			row = data.Contexts[normalized[offsets[i-length]:offsets[i]]]
+		}
+
+		if row == nil {
+			previous, found := data.Positions[runes[i-1]]
+			if !found {
+				return -1, 0, fmt.Errorf("AverageNGramProbability: unable to find the position of the rune %s", string(runes[i-1]))
+			}
+			row = data.Occurrences[previous]
+		}
+
+		logProb += row[position]
+		transitions++
+		if logProbs != nil {
+			*logProbs = append(*logProbs, row[position])
+		}
+
+	}
+
+	return logProb, transitions, nil
+
+}
+
 // GetDigraphs returns pairs of adjacent runes, after
 // normalizing the input line.
+//
+// Deprecated: it normalizes the input with
+// consts.AcceptedCharacters. Use GetAlphabetDigraphs with the
+// alphabet of the model instead.
 func GetDigraphs(line string) []structs.Digraph {
 
-	runes := Normalize(line)
+	return GetAlphabetDigraphs(line, consts.AcceptedCharacters)
+
+}
+
+// GetAlphabetDigraphs returns pairs of adjacent runes, after
+// normalizing the input line with the given alphabet.
+func GetAlphabetDigraphs(line string, alphabet string) []structs.Digraph {
+
+	runes := NormalizeAlphabet(line, alphabet)
 	if len(runes) == 0 {
 		return []structs.Digraph{}
 	}
@@ -73,14 +213,26 @@ func GetDigraphs(line string) []structs.Digraph {
 // that are in the accepted characters. This helps
 // keeping the  model relatively small by ignoring
 // punctuation, symbols, etc.
+//
+// Deprecated: it normalizes the input with
+// consts.AcceptedCharacters. Use NormalizeAlphabet with the
+// alphabet of the model instead.
 func Normalize(line string) []rune {
 
+	return NormalizeAlphabet(line, consts.AcceptedCharacters)
+
+}
+
+// NormalizeAlphabet returns the subset of runes in the
+// lowercased line that are in the alphabet.
+func NormalizeAlphabet(line string, alphabet string) []rune {
+
 	line = strings.ToLower(line)
 	result := make([]rune, 0, len(line))
 
 	for _, r := range line {
 
-		if strings.ContainsRune(consts.AcceptedCharacters, r) {
+		if strings.ContainsRune(alphabet, r) {
 			result = append(result, r)
 		}
 
@@ -0,0 +1,111 @@
+package clusterurl
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ClusterURLs clusters a batch of paths on Config.Workers goroutines and
+// returns the results in the order of the paths. Identical paths are
+// clustered only once.
+func (csf *ClusterURLClassifier) ClusterURLs(paths []string) []string {
+	out := make([]string, len(paths))
+
+	// first maps each distinct path to the index of its first occurrence.
+	first := make(map[string]int, len(paths))
+	distinct := make([]int, 0, len(paths))
+	for i, path := range paths {
+		if _, ok := first[path]; !ok {
+			first[path] = i
+			distinct = append(distinct, i)
+		}
+	}
+
+	workers := csf.workers()
+	if workers > len(distinct) {
+		workers = len(distinct)
+	}
+
+	// Workers pick the next distinct path from a shared counter, so that a
+	// few slow paths do not hold up a whole share of the batch.
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(distinct) {
+					return
+				}
+				j := distinct[i]
+				out[j] = csf.ClusterURL(paths[j])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(distinct) < len(paths) {
+		for i, path := range paths {
+			out[i] = out[first[path]]
+		}
+	}
+
+	return out
+}
+
+// ClusterURLStream clusters the paths received from in on Config.Workers
+// goroutines. The results are sent in the order of the paths, and the
+// returned channel is closed once in is closed and every path has been
+// clustered. The returned channel must be drained, otherwise the workers
+// block forever.
+func (csf *ClusterURLClassifier) ClusterURLStream(in <-chan string) <-chan string {
+	workers := csf.workers()
+	out := make(chan string, workers)
+	jobs := make(chan streamJob, workers)
+	// pending holds the result of each path in the order of the input, so
+	// that at most workers paths are clustered ahead of the oldest one.
+	pending := make(chan chan string, workers)
+
+	go func() {
+		for path := range in {
+			result := make(chan string, 1)
+			pending <- result
+			jobs <- streamJob{path: path, result: result}
+		}
+		close(jobs)
+		close(pending)
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for job := range jobs {
+				job.result <- csf.ClusterURL(job.path)
+			}
+		}()
+	}
+
+	go func() {
+		for result := range pending {
+			out <- <-result
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+type streamJob struct {
+	path   string
+	result chan<- string
+}
+
+func (csf *ClusterURLClassifier) workers() int {
+	if csf.cfg.Workers > 0 {
+		return csf.cfg.Workers
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,173 @@
+package clusterurl
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCardinalityNodes is the number of prefixes remembered when
+// Config.CardinalityNodes is not set.
+const defaultCardinalityNodes = 10000
+
+// prefixTree remembers the paths seen by the classifier, to find the
+// prefixes followed by too many distinct segments, the way the Drain log
+// parser finds the variable parts of log lines. This catches the IDs that
+// look like words, such as user names or slugs.
+type prefixTree struct {
+	mu        sync.Mutex
+	root      *prefixNode
+	threshold int
+	// budget is the maximum number of nodes, and nodes the current one.
+	budget int
+	nodes  int
+	// generation counts the collapses, so that a path clustered before a
+	// collapse is not cached after the cache was purged.
+	generation atomic.Uint64
+}
+
+// prefixNode is a prefix of the observed paths.
+type prefixNode struct {
+	// children are the segments kept after the prefix.
+	children map[string]*prefixNode
+	// wildcard follows the replaced segments after the prefix.
+	wildcard *prefixNode
+	// distinct is the number of children that can be collapsed.
+	distinct int
+	// collapsed is true once the prefix had too many distinct children.
+	// From then on, the segments following it are replaced.
+	collapsed bool
+	// pinned is true if the segment was kept by an explicit rule, such as
+	// an override or a route, and must never be collapsed.
+	pinned bool
+}
+
+func newPrefixTree(config *Config) *prefixTree {
+	if config.CardinalityThreshold == 0 {
+		return nil
+	}
+
+	budget := config.CardinalityNodes
+	if budget == 0 {
+		budget = defaultCardinalityNodes
+	}
+
+	return &prefixTree{
+		root:      &prefixNode{},
+		threshold: config.CardinalityThreshold,
+		budget:    budget,
+		nodes:     1,
+	}
+}
+
+// observe records the segment after the prefix reached by the path, and
+// returns the decision for it, which is changed to a replacement if the
+// prefix has too many distinct children. When the memory budget is
+// exhausted, the rest of the path is not learned. Unless st.learn is set,
+// the tree is only followed, not changed.
+func (csf *ClusterURLClassifier) observe(seg string, dec decision, st *pathState) decision {
+	t := csf.prefixes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node := st.node
+	collapsible := dec.keep && (dec.heuristic() || dec.rule == RuleNone)
+	if collapsible && node.collapsed {
+		dec = decision{rule: RuleCardinality, text: dec.text}
+	}
+	if !dec.keep {
+		if st.learn {
+			st.node = t.wildcard(node)
+		} else {
+			st.node = node.wildcard
+		}
+		return dec
+	}
+
+	if child, ok := node.children[seg]; ok {
+		st.node = child
+		return dec
+	}
+	if !st.learn || t.nodes >= t.budget {
+		st.node = nil
+		return dec
+	}
+
+	child := &prefixNode{pinned: !collapsible}
+	if node.children == nil {
+		node.children = map[string]*prefixNode{}
+	}
+	// The segment may point to a buffer owned by the caller of
+	// AppendClusterURL.
+	node.children[strings.Clone(seg)] = child
+	t.nodes++
+	st.node = child
+	if !collapsible {
+		return dec
+	}
+
+	node.distinct++
+	if node.distinct <= t.threshold {
+		return dec
+	}
+
+	t.collapse(node)
+	// The cached paths may hold the segments that were just collapsed.
+	t.generation.Add(1)
+	if paths := csf.state.Load().paths; paths != nil {
+		paths.purge()
+	}
+	st.node = t.wildcard(node)
+
+	return decision{rule: RuleCardinality, text: dec.text}
+}
+
+// wildcard returns the node following the replaced segments after node, or
+// nil if the memory budget is exhausted.
+func (t *prefixTree) wildcard(node *prefixNode) *prefixNode {
+	if node.wildcard == nil {
+		if t.nodes >= t.budget {
+			return nil
+		}
+		node.wildcard = &prefixNode{}
+		t.nodes++
+	}
+
+	return node.wildcard
+}
+
+// collapse forgets the children of node that can be collapsed, and what was
+// learned after them.
+func (t *prefixTree) collapse(node *prefixNode) {
+	for seg, child := range node.children {
+		if !child.pinned {
+			t.nodes -= child.size()
+			delete(node.children, seg)
+		}
+	}
+	node.distinct = 0
+	node.collapsed = true
+}
+
+// size returns the number of nodes of the subtree starting at node.
+func (node *prefixNode) size() int {
+	n := 1
+	for _, child := range node.children {
+		n += child.size()
+	}
+	if node.wildcard != nil {
+		n += node.wildcard.size()
+	}
+
+	return n
+}
+
+// generation returns the number of collapses so far, or zero if nothing is
+// learned.
+func (csf *ClusterURLClassifier) generation() uint64 {
+	if csf.prefixes == nil {
+		return 0
+	}
+
+	return csf.prefixes.generation.Load()
+}
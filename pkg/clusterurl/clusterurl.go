@@ -2,20 +2,31 @@ package clusterurl
 
 import (
 	"embed"
-	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+	"unsafe"
 
 	"github.com/grafana/clusterurl/pkg/gibberish"
+	"github.com/grafana/clusterurl/pkg/persistence"
 	"github.com/grafana/clusterurl/pkg/structs"
-	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 type ClusterURLClassifier struct {
-	classifier     *structs.GibberishData
-	cache          *lru.Cache[string, bool]
-	cfg            *Config
-	validCharTable [256]bool
+	state           atomic.Pointer[state]
+	mu              sync.Mutex // serializes the updates of state
+	pathHits        atomic.Uint64
+	pathMisses      atomic.Uint64
+	cfg             *Config
+	validCharTable  [256]bool
+	routes          *routeNode
+	prefixes        *prefixTree
+	methods         map[string]struct{}
+	extensionDelims []byte
 }
 
 func NewClusterURLClassifier(config *Config) (*ClusterURLClassifier, error) {
@@ -27,14 +38,32 @@ func NewClusterURLClassifier(config *Config) (*ClusterURLClassifier, error) {
 		return nil, fmt.Errorf("NewClusterURLClassifier: invalid configuration: %w", err)
 	}
 
-	classifier, err := loadKnowledgeBase(config.ModelPath)
+	bundle, err := loadKnowledgeBase(config.ModelPath, config.Language)
 	if err != nil {
 		return nil, fmt.Errorf("NewClusterURLClassifier: unable to load knowledge base: %w", err)
 	}
 
-	cache, err := lru.New[string, bool](config.CacheSize)
+	cache, rejected, err := newWordCaches(config)
 	if err != nil {
-		return nil, fmt.Errorf("NewClusterURLClassifier: unable to create cache: %w", err)
+		return nil, fmt.Errorf("NewClusterURLClassifier: %w", err)
+	}
+
+	routes, err := newRouteTrie(config.Routes, config.Separator)
+	if err != nil {
+		return nil, fmt.Errorf("NewClusterURLClassifier: invalid routes: %w", err)
+	}
+
+	overrides, err := loadOverrides(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewClusterURLClassifier: invalid overrides: %w", err)
+	}
+
+	var methods map[string]struct{}
+	if config.ParseMethod {
+		methods, err = newMethodSet(config.Methods)
+		if err != nil {
+			return nil, fmt.Errorf("NewClusterURLClassifier: invalid methods: %w", err)
+		}
 	}
 
 	// Initialize lookup table for valid characters
@@ -48,129 +77,415 @@ func NewClusterURLClassifier(config *Config) (*ClusterURLClassifier, error) {
 	for _, c := range config.AdditionalValidChars {
 		validCharTable[c] = true
 	}
+	if config.DecodePercent {
+		// Encoded separators are part of the segment.
+		validCharTable[config.Separator] = true
+	}
+
+	csf := &ClusterURLClassifier{
+		cfg:             config,
+		validCharTable:  validCharTable,
+		routes:          routes,
+		prefixes:        newPrefixTree(config),
+		methods:         methods,
+		extensionDelims: append(append([]byte{}, extensionDelims...), config.InnerDelimiters...),
+	}
 
-	return &ClusterURLClassifier{
-		classifier:     classifier,
-		cache:          cache,
-		cfg:            config,
-		validCharTable: validCharTable,
-	}, nil
+	st, err := csf.newState(bundle, cache, rejected, overrides, config.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("NewClusterURLClassifier: invalid rules: %w", err)
+	}
+	csf.state.Store(st)
+
+	return csf, nil
 }
 
 // This function takes a path and returns a "clustered" path, where
-// all the "IDs" in the path are replaced by a single "*" character.
+// all the "IDs" in the path are replaced by a placeholder, by default a
+// single "*" character (see Config.PlaceholderStyle).
 // For example, the path "/foo/42/baz" would be replaced with "/foo/*/baz".
 // The purpose of this function is to allow for a large number of paths
 // to be grouped into a smaller number of paths.
-
-//nolint:cyclop
 func (csf *ClusterURLClassifier) ClusterURL(path string) string {
 	if path == "" {
 		return path
 	}
 
-	p := []byte(path)
-	sPos := 0
-	sFwd := 0
+	paths := csf.state.Load().paths
+	if paths == nil {
+		return string(csf.cluster(make([]byte, 0, len(path)), path, nil))
+	}
 
-	skip := false
-	skipGrace := true
-	nSegments := 0
-	for _, c := range p {
-		char := c
-
-		// Strip query string and fragment identifiers
-		if c == '?' || c == '&' || c == '#' {
-			if skip && sPos < len(p) {
-				// no other chars, just use ReplaceWith
-				p[sPos] = csf.cfg.ReplaceWith
-				sPos++
-			} else if !skip && sFwd > sPos {
-				// preserve chars
-				sPos = sFwd
-			}
+	key := csf.pathCacheKey(path)
+	if out, ok := csf.lookupPath(paths, key); ok {
+		return out
+	}
+
+	generation := csf.generation()
+	out := string(csf.cluster(make([]byte, 0, len(path)), path, nil))
+	csf.storePath(paths, strings.Clone(key), out, generation)
+	return out
+}
+
+// AppendClusterURL appends the clustered version of src to dst and returns
+// the extended buffer. It is the byte slice equivalent of ClusterURL: src
+// is not copied and, when its segments are found in the caches, nothing is
+// allocated. dst and src must not overlap.
+func (csf *ClusterURLClassifier) AppendClusterURL(dst, src []byte) []byte {
+	if len(src) == 0 {
+		return dst
+	}
+
+	path := unsafe.String(unsafe.SliceData(src), len(src))
+	paths := csf.state.Load().paths
+	if paths == nil {
+		return csf.cluster(dst, path, nil)
+	}
+
+	key := csf.pathCacheKey(path)
+	if out, ok := csf.lookupPath(paths, key); ok {
+		return append(dst, out...)
+	}
+
+	n := len(dst)
+	generation := csf.generation()
+	dst = csf.cluster(dst, path, nil)
+	// The key points to the buffer of the caller.
+	csf.storePath(paths, strings.Clone(key), string(dst[n:]), generation)
+	return dst
+}
+
+// ClusterURLWithDetails clusters the path exactly like ClusterURL, but it
+// also reports how every segment was handled and which rule decided it.
+// It is meant for debugging unexpected routes and it is noticeably slower
+// than ClusterURL, so it should not be used in the hot path.
+func (csf *ClusterURLClassifier) ClusterURLWithDetails(path string) *Details {
+	d := &Details{
+		Input:     path,
+		Threshold: csf.state.Load().threshold(),
+	}
+	if path == "" {
+		return d
+	}
+
+	d.Output = string(csf.cluster(make([]byte, 0, len(path)), path, d))
+	return d
+}
 
-			p = p[:sPos]
-			break
-		}
-
-		if c == csf.cfg.Separator {
-			nSegments++
-			if skip {
-				p[sPos] = csf.cfg.ReplaceWith
-				sPos++
-			} else if sFwd > sPos {
-				if !csf.okWord(string(p[sPos:sFwd])) {
-					p[sPos] = csf.cfg.ReplaceWith
-					sPos++
-				} else {
-					sPos = sFwd
-				}
+// cluster appends the clustered version of path to dst. When d is not nil,
+// the decision taken for every segment is recorded in it.
+func (csf *ClusterURLClassifier) cluster(dst []byte, path string, d *Details) []byte {
+	if csf.methods != nil {
+		var method string
+		if method, path = csf.splitMethod(path); method != "" {
+			if d != nil {
+				d.Method = method
 			}
+			dst = append(dst, method...)
+			dst = append(dst, ' ')
+		}
+	}
+
+	if prefix, rest, ok := splitAbsoluteURL(path); ok {
+		dst = csf.appendURLPrefix(dst, prefix, d)
+		path = rest
+		if path == "" || path[0] != csf.cfg.Separator {
+			// The path of an absolute URL is never empty.
+			dst = append(dst, csf.cfg.Separator)
+			path = path[queryStart(path):]
+		}
+	}
+
+	end := queryStart(path)
+	dst = csf.clusterPath(dst, path[:end], d)
+
+	// Strip query string and fragment identifiers, unless query keys must
+	// be preserved.
+	if end < len(path) && path[end] != '#' && csf.cfg.Query != "" && csf.cfg.Query != QueryStrip {
+		dst = csf.appendQuery(dst, path[end+1:], d)
+	}
+
+	return dst
+}
 
-			if nSegments >= csf.cfg.MaxSegments {
-				break
+// clusterPath appends the clustered version of a path without query string.
+func (csf *ClusterURLClassifier) clusterPath(dst []byte, path string, d *Details) []byte {
+	if csf.routes != nil {
+		if template, ok := csf.routes.match(path, csf.cfg.Separator); ok {
+			if d != nil {
+				d.addRoute(path, template, csf.cfg.Separator)
 			}
+			return append(dst, template...)
+		}
+	}
+
+	st := pathState{route: csf.routes}
+	if csf.prefixes != nil {
+		st.node = csf.prefixes.root
+		// Debugging a path must not change how the next ones are clustered.
+		st.learn = d == nil
+	}
+	if csf.cfg.TailPolicy == TailKeepLast {
+		return csf.clusterLastSegments(dst, path, &st, d)
+	}
 
-			p[sPos] = char
-			sPos++
-			sFwd = sPos
-			skip = false
-			skipGrace = true
-		} else if !skip {
-			p[sFwd] = c
-			sFwd++
-			if !csf.validCharTable[c] {
-				if skipGrace && (sFwd-sPos) == 2 {
-					skipGrace = false
-					continue
-				}
-				skip = true
+	return csf.clusterSegments(dst, path, &st, d)
+}
+
+// clusterSegments appends the clustered segments of path, up to
+// MaxSegments, followed by the tail required by the TailPolicy.
+func (csf *ClusterURLClassifier) clusterSegments(dst []byte, path string, st *pathState, d *Details) []byte {
+	nSegments := 0
+	start := 0
+	for {
+		end := strings.IndexByte(path[start:], csf.cfg.Separator)
+		if end < 0 {
+			st.last = true
+			return csf.appendSegment(dst, path[start:], st, d)
+		}
+		end += start
+		dst = csf.appendSegment(dst, path[start:end], st, d)
+
+		nSegments++
+		st.index++
+		if nSegments >= csf.cfg.MaxSegments {
+			return csf.appendTail(dst, path[end+1:], st, d)
+		}
+
+		dst = append(dst, csf.cfg.Separator)
+		start = end + 1
+	}
+}
+
+// queryStart returns the index of the query string or fragment, or the
+// length of the path if it has none.
+func queryStart(path string) int {
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '?', '&', '#':
+			return i
+		}
+	}
+
+	return len(path)
+}
+
+// decision is the outcome of the classification of a segment.
+type decision struct {
+	// rule is the rule that took the decision.
+	rule string
+	// keep is true if the segment must be kept as is.
+	keep bool
+	// grace is true if an invalid character in second position was tolerated.
+	grace bool
+	// kind is the kind of identifier the segment looks like, if any.
+	kind string
+	// text is the classified text, which differs from the segment when it
+	// is percent-decoded.
+	text string
+}
+
+func (csf *ClusterURLClassifier) appendSegment(dst []byte, seg string, st *pathState, d *Details) []byte {
+	base, params := csf.splitMatrixParams(seg)
+	dec := csf.decide(base, st)
+	if st.node != nil {
+		dec = csf.observe(base, dec, st)
+	}
+	start := len(dst)
+	switch {
+	case dec.keep:
+		dst = append(dst, base...)
+		st.prev = base
+	case st.last && csf.cfg.KeepExtensions && dec.heuristic() && csf.extension(base) != "":
+		ext := csf.extension(base)
+		dst, _ = csf.appendTokens(dst, base[:len(base)-len(ext)], csf.extensionDelims, st)
+		dst = append(dst, ext...)
+		dec.rule = RuleExtension
+		st.prev = ""
+	default:
+		var kept bool
+		names := len(st.names)
+		if len(csf.cfg.InnerDelimiters) > 0 && dec.heuristic() {
+			dst, kept = csf.appendTokens(dst, base, csf.cfg.InnerDelimiters, st)
+		}
+		if kept {
+			dec.rule = RulePartial
+		} else {
+			// Forget the names of the discarded token placeholders.
+			st.names = st.names[:names]
+			dst = csf.appendPlaceholder(dst[:start], dec, st)
+		}
+		st.prev = ""
+	}
+	if params != "" {
+		dst = csf.appendMatrixParams(dst, params)
+	}
+
+	if d != nil {
+		d.Segments = append(d.Segments, csf.segmentDetails(seg, string(dst[start:]), dec))
+	}
+
+	return dst
+}
+
+func (csf *ClusterURLClassifier) segmentDetails(raw, output string, dec decision) SegmentDetails {
+	sd := SegmentDetails{
+		Raw:         raw,
+		Output:      output,
+		Rule:        dec.rule,
+		Grace:       dec.grace,
+		Kind:        dec.kind,
+		Probability: -1,
+		Confidence:  -1,
+	}
+	if dec.text != raw {
+		sd.Decoded = dec.text
+	}
+	if dec.rule == RuleModel || dec.rule == RuleUncertain {
+		var score gibberish.Result
+		sd.Language, score = csf.state.Load().score(dec.text)
+		sd.Probability, sd.Confidence = score.Probability, score.Confidence
+	}
+
+	return sd
+}
+
+// decide tells whether the segment must be kept and which rule decided it.
+func (csf *ClusterURLClassifier) decide(seg string, st *pathState) decision {
+	if st.route != nil {
+		var static bool
+		st.route, static = st.route.next(seg)
+		if static {
+			return decision{rule: RuleRoute, keep: true, text: seg}
+		}
+	}
+
+	if seg == "" {
+		return decision{rule: RuleEmpty, keep: true}
+	}
+
+	s := Segment{Text: seg, Raw: seg, Index: st.index}
+	if csf.cfg.DecodePercent {
+		s.Text = decodePercent(seg)
+	}
+
+	var grace bool
+	for _, rule := range csf.state.Load().bound {
+		dec, ok := rule(s)
+		grace = grace || dec.grace
+		if ok {
+			dec.grace = grace
+			if dec.text == "" {
+				dec.text = s.Text
 			}
+			return dec
 		}
 	}
 
-	// this can happen if we have path with ?, & or # and all invalid chars, but no /
-	if len(p) == 0 {
-		return ""
+	return decision{rule: RuleNone, keep: true, grace: grace, text: s.Text}
+}
+
+// decodePercent returns the percent-decoded segment, or the segment itself
+// if it is not encoded or not correctly encoded.
+func decodePercent(seg string) string {
+	if strings.IndexByte(seg, '%') < 0 {
+		return seg
+	}
+
+	decoded, err := url.PathUnescape(seg)
+	if err != nil {
+		return seg
 	}
 
-	if skip {
-		if sPos < len(p) {
-			p[sPos] = csf.cfg.ReplaceWith
-			sPos++
+	return decoded
+}
+
+// invalidChar reports whether the segment contains characters that are not
+// allowed in a word. A single invalid character in second position is
+// tolerated, so that segments like "v1" or "k6-test-runs" are still handed
+// to the model; grace reports whether that happened.
+func (csf *ClusterURLClassifier) invalidChar(st *state, seg string) (invalid bool, grace bool) {
+	for i := 0; i < len(seg); i++ {
+		if st.validCharTable[seg[i]] {
+			continue
 		}
-	} else if sFwd > sPos {
-		if !csf.okWord(string(p[sPos:sFwd])) {
-			if sPos < len(p) {
-				p[sPos] = csf.cfg.ReplaceWith
-				sPos++
+		if seg[i] >= utf8.RuneSelf && csf.cfg.Unicode {
+			r, size := utf8.DecodeRuneInString(seg[i:])
+			if isUnicodeLetter(r) {
+				i += size - 1
+				continue
 			}
-		} else {
-			sPos = sFwd
+		}
+		if i == 1 {
+			grace = true
+			continue
+		}
+		return true, grace
+	}
+
+	return false, grace
+}
+
+// okWord tells whether the model accepts the word, and whether its verdict
+// was uncertain, in which case Config.UncertainPolicy was applied.
+func (csf *ClusterURLClassifier) okWord(st *state, w string) (keep, uncertain bool) {
+	// The caches hold the final verdicts, and whether they were uncertain.
+	if uncertain, ok := st.cache.Get(w); ok {
+		return true, uncertain
+	}
+	if st.rejected != nil {
+		if uncertain, ok := st.rejected.Get(w); ok {
+			return false, uncertain
+		}
+	}
+
+	if st.model != nil && csf.cfg.UncertainConfidence == 0 {
+		// The confidence is not needed, only the verdict.
+		keep = !gibberish.IsGibberish(w, st.model)
+	} else {
+		_, score := st.score(w)
+		keep = !score.Gibberish()
+		uncertain = score.Confidence < csf.cfg.UncertainConfidence
+	}
+	if uncertain {
+		switch csf.cfg.UncertainPolicy {
+		case UncertainKeep:
+			keep = true
+		case UncertainReplace:
+			keep = false
 		}
 	}
 
-	return string(p[:sPos])
+	// The word may point to a buffer owned by the caller of
+	// AppendClusterURL, so the caches must keep their own copy.
+	if !keep {
+		if st.rejected != nil {
+			st.rejected.Add(strings.Clone(w), uncertain)
+		}
+		return false, uncertain
+	}
+
+	st.cache.Add(strings.Clone(w), uncertain)
+	return true, uncertain
 }
 
-func (csf *ClusterURLClassifier) okWord(w string) bool {
-	_, ok := csf.cache.Get(w)
-	if ok {
-		return ok
+func loadOverrides(config *Config) (*overrideSet, error) {
+	if config.OverridesPath == "" {
+		return newOverrideSet(&config.Overrides)
 	}
-	if gibberish.IsGibberish(w, csf.classifier) {
-		return false
+
+	fromFile, err := LoadOverrides(config.OverridesPath)
+	if err != nil {
+		return nil, err
 	}
 
-	csf.cache.Add(w, true)
-	return true
+	return newOverrideSet(&config.Overrides, fromFile)
 }
 
 //go:embed model.json
 var dataFile embed.FS
 
-func loadKnowledgeBase(path string) (*structs.GibberishData, error) {
+func loadKnowledgeBase(path string, language string) (*structs.GibberishBundle, error) {
 	var content []byte
 	var err error
 	if path != "" {
@@ -183,11 +498,24 @@ func loadKnowledgeBase(path string) (*structs.GibberishData, error) {
 		return nil, fmt.Errorf("loadKnowledgeBase: unable to read knowledge base content: %w", err)
 	}
 
-	var data structs.GibberishData
-	err = json.Unmarshal(content, &data)
+	bundle, err := persistence.UnmarshalBundle(content)
 	if err != nil {
-		return nil, fmt.Errorf("loadKnowledgeBase: unable to unmarshal knowledge base content: %w", err)
+		return nil, fmt.Errorf("loadKnowledgeBase: %w", err)
+	}
+
+	if err := checkLanguage(bundle, language); err != nil {
+		return nil, fmt.Errorf("loadKnowledgeBase: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// checkLanguage checks that the bundle has a model for the language hint,
+// if it is set.
+func checkLanguage(bundle *structs.GibberishBundle, language string) error {
+	if _, ok := bundle.Models[language]; language != "" && !ok {
+		return fmt.Errorf("no model for the language %q", language)
 	}
 
-	return &data, nil
+	return nil
 }
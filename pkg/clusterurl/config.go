@@ -1,28 +1,165 @@
 package clusterurl
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Config struct {
 	// MaxSegments is the maximum number of segments in a path.
 	MaxSegments int `json:"max_segments"`
+	// TailPolicy defines what happens to the segments beyond MaxSegments.
+	// Defaults to TailDrop.
+	TailPolicy TailPolicy `json:"tail_policy,omitempty"`
+	// TailMarker is the segment marking that a path was truncated, used by
+	// the TailMarker and TailKeepLast policies.
+	TailMarker string `json:"tail_marker,omitempty"`
 	// Separator is the character that separates segments in a path.
 	Separator byte `json:"separator"`
-	// ReplaceWith is the character that will replace the segments in a path.
+	// ReplaceWith is the character that will replace the segments in a path
+	// when PlaceholderStyle is StyleGlob.
 	ReplaceWith byte `json:"replace_with"`
+	// PlaceholderStyle defines how replaced segments are written. Defaults
+	// to StyleGlob.
+	PlaceholderStyle PlaceholderStyle `json:"placeholder_style,omitempty"`
+	// Placeholder is the text replacing the segments in a path when
+	// PlaceholderStyle is StyleCustom.
+	Placeholder string `json:"placeholder,omitempty"`
 	// CacheSize is the size of the cache for the classifier.
 	CacheSize int `json:"cache_size"`
+	// NegativeCacheSize is the size of the cache for the segments rejected
+	// by the model, separate from the cache of the accepted ones. Zero
+	// disables it.
+	NegativeCacheSize int `json:"negative_cache_size"`
+	// PathCacheSize is the size of the cache of whole clustered paths,
+	// keyed by the input without its query string unless Query keeps it.
+	// Zero disables the cache.
+	PathCacheSize int `json:"path_cache_size,omitempty"`
+	// PathCachePolicy is the eviction policy of the path cache. Defaults to
+	// CacheLRU.
+	PathCachePolicy CachePolicy `json:"path_cache_policy,omitempty"`
 	// Additional characters that are considered valid in a segment.
 	AdditionalValidChars []byte `json:"additional_chars,omitempty"`
-	// ModelPath is the path to the model file.
+	// ModelPath is the path to the model file. It can hold a single model
+	// or a bundle of models, one per language.
 	ModelPath string `json:"model_path"`
+	// Language hints at the language of the traffic. The model of the
+	// bundle for this language is scored first, and is the one reported
+	// unless another model accepts a segment it rejects: a segment is
+	// still a word if any model of the bundle accepts it. It must name a
+	// model of the bundle.
+	Language string `json:"language,omitempty"`
+	// DecodePercent classifies segments after percent-decoding them, so
+	// "my%20report" is classified as "my report". Kept segments are still
+	// written with their original encoding, and encoded separators are
+	// part of the segment.
+	DecodePercent bool `json:"decode_percent"`
+	// Unicode accepts the letters of any script in segments, instead of the
+	// ASCII letters only. Latin segments with diacritics are folded to
+	// ASCII and scored by the model, the other scripts are handled
+	// according to ScriptPolicies.
+	Unicode bool `json:"unicode"`
+	// ScriptPolicies defines how segments in a given Unicode script, such
+	// as "Cyrillic" or "Han", are classified. Scripts other than Latin are
+	// kept by default. Segments made of ASCII characters only are always
+	// handed to the model.
+	ScriptPolicies map[string]ScriptPolicy `json:"script_policies,omitempty"`
+	// MatrixParams defines what happens to matrix parameters, like in
+	// /item;color=red. Defaults to MatrixOff.
+	MatrixParams MatrixMode `json:"matrix_params,omitempty"`
+	// SessionParams are matrix parameters that are always dropped, in
+	// addition to jsessionid, phpsessid and sid. Names are case insensitive.
+	SessionParams []string `json:"session_params,omitempty"`
+	// KeepExtensions keeps the file extension of the last segment when it
+	// is replaced, and classifies the dot-separated parts of the file name
+	// separately: /static/app.3f9a8c1d.js becomes /static/app.*.js.
+	KeepExtensions bool `json:"keep_extensions"`
+	// Extensions are file extensions recognised in addition to the common
+	// web ones (js, css, png, ...) when KeepExtensions is set.
+	Extensions []string `json:"extensions,omitempty"`
+	// InnerDelimiters split segments into tokens that are classified
+	// separately, so that only the dynamic ones are replaced: with "-_x",
+	// order-123456 becomes order-* and thumb_640x480 becomes thumb_*. The
+	// whole segment is replaced only if all its tokens are. Letters and
+	// digits only delimit tokens between two digits.
+	InnerDelimiters []byte `json:"inner_delimiters,omitempty"`
+	// ParseMethod recognises a leading HTTP method, like in "GET /users",
+	// and keeps it verbatim instead of treating it as part of the path.
+	ParseMethod bool `json:"parse_method"`
+	// Methods are custom methods recognised along with the standard HTTP
+	// and WebDAV ones when ParseMethod is set.
+	Methods []string `json:"methods,omitempty"`
+	// KeepScheme, KeepUserInfo, KeepHost and KeepPort define which parts of
+	// absolute URLs, such as "https://user@api.example.com:8443/users/42",
+	// are kept in the output. Only the path is kept by default. The user
+	// info and the port are only kept along with the host.
+	KeepScheme   bool `json:"keep_scheme"`
+	KeepUserInfo bool `json:"keep_user_info"`
+	KeepHost     bool `json:"keep_host"`
+	KeepPort     bool `json:"keep_port"`
+	// ClusterHost replaces the dynamic labels of the host of absolute URLs,
+	// e.g. tenant-8f3a.example.com becomes *.example.com. It only applies
+	// if KeepHost is set.
+	ClusterHost bool `json:"cluster_host"`
+	// Query defines what happens to the query string. Defaults to
+	// QueryStrip.
+	Query QueryMode `json:"query,omitempty"`
+	// Routes are known route templates, such as "/users/{id}/jobs/{jobId}".
+	// Paths matching a template are clustered to the template itself, and
+	// the literal segments of the templates are never replaced. Parameters
+	// can be written as {name}, :name or *.
+	Routes []string `json:"routes,omitempty"`
+	// Overrides lists segments that are always kept or always replaced.
+	Overrides Overrides `json:"overrides"`
+	// OverridesPath is the path to a JSON file with additional overrides,
+	// merged with Overrides.
+	OverridesPath string `json:"overrides_path,omitempty"`
+	// Rules is the chain of rules classifying each segment. Defaults to the
+	// built-in rules BuiltinOverridesRule, BuiltinIDShapeRule (only with
+	// TypedPlaceholders), BuiltinInvalidCharRule and BuiltinModelRule,
+	// which can be mixed with custom rules in any order.
+	Rules []SegmentRule `json:"-"`
+	// TypedPlaceholders replaces segments that look like well-known kinds of
+	// identifiers. With StyleGlob the placeholder names the kind, e.g.
+	// "{int}", "{uuid}" or "{hash}".
+	TypedPlaceholders bool `json:"typed_placeholders"`
+	// FallbackPlaceholder replaces the segments that do not match any known
+	// kind when TypedPlaceholders is enabled. Defaults to ReplaceWith.
+	FallbackPlaceholder string `json:"fallback_placeholder,omitempty"`
+	// CardinalityThreshold enables learning from the paths seen by the
+	// classifier. Once more than CardinalityThreshold distinct segments
+	// accepted by the model follow the same prefix, they are all replaced,
+	// e.g. the user names in /users/alice and /users/bob. Zero disables it.
+	CardinalityThreshold int `json:"cardinality_threshold,omitempty"`
+	// CardinalityNodes bounds the number of prefixes remembered when
+	// CardinalityThreshold is set. Defaults to 10000.
+	CardinalityNodes int `json:"cardinality_nodes,omitempty"`
+	// UncertainConfidence is the confidence under which the verdict of the
+	// gibberish model is uncertain, typically for short segments or
+	// segments close to the threshold. Uncertain segments are handled
+	// according to UncertainPolicy. Zero disables it.
+	UncertainConfidence float64 `json:"uncertain_confidence,omitempty"`
+	// UncertainPolicy defines what happens to the uncertain segments.
+	// Defaults to UncertainModel.
+	UncertainPolicy UncertainPolicy `json:"uncertain_policy,omitempty"`
+	// Workers is the number of goroutines used by ClusterURLs and
+	// ClusterURLStream. Defaults to GOMAXPROCS.
+	Workers int `json:"workers,omitempty"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		MaxSegments:          10,
+		TailPolicy:           TailDrop,
+		TailMarker:           "**",
 		Separator:            '/',
 		ReplaceWith:          '*',
+		PlaceholderStyle:     StyleGlob,
+		Query:                QueryStrip,
+		MatrixParams:         MatrixOff,
+		ParseMethod:          true,
 		CacheSize:            8192,
+		NegativeCacheSize:    8192,
 		AdditionalValidChars: []byte{'-', '_', '.', ' '},
 		ModelPath:            "",
 	}
@@ -32,15 +169,81 @@ func (c *Config) Validate() error {
 	if c.MaxSegments <= 0 {
 		return fmt.Errorf("field MaxSegments must be greater than 0")
 	}
+	switch c.TailPolicy {
+	case "", TailDrop, TailWildcard:
+	case TailKeepLast:
+		if c.MaxSegments < 2 {
+			return fmt.Errorf("field MaxSegments must be at least 2 with the keep_last tail policy")
+		}
+	case TailMarker:
+		if c.TailMarker == "" {
+			return fmt.Errorf("field TailMarker cannot be empty with the marker tail policy")
+		}
+	default:
+		return fmt.Errorf("unknown tail policy %q", c.TailPolicy)
+	}
+	if strings.IndexByte(c.TailMarker, c.Separator) >= 0 {
+		return fmt.Errorf("field TailMarker cannot contain the separator")
+	}
 	if c.Separator == 0 {
 		return fmt.Errorf("field Separator cannot be zero")
 	}
 	if c.ReplaceWith == 0 {
 		return fmt.Errorf("field ReplaceWith cannot be zero")
 	}
+	switch c.PlaceholderStyle {
+	case "", StyleGlob, StyleOpenAPI, StyleColon:
+	case StyleCustom:
+		if c.Placeholder == "" {
+			return fmt.Errorf("field Placeholder cannot be empty with the custom placeholder style")
+		}
+	default:
+		return fmt.Errorf("unknown placeholder style %q", c.PlaceholderStyle)
+	}
+	switch c.Query {
+	case "", QueryStrip, QueryDropValues, QueryWildcardValues:
+	default:
+		return fmt.Errorf("unknown query mode %q", c.Query)
+	}
+	switch c.MatrixParams {
+	case "", MatrixOff, MatrixStrip, MatrixWildcard:
+	default:
+		return fmt.Errorf("unknown matrix parameters mode %q", c.MatrixParams)
+	}
+	if err := validateScriptPolicies(c.ScriptPolicies); err != nil {
+		return fmt.Errorf("field ScriptPolicies is invalid: %w", err)
+	}
 	if c.CacheSize <= 0 {
 		return fmt.Errorf("field CacheSize must be greater than 0")
 	}
+	if c.NegativeCacheSize < 0 {
+		return fmt.Errorf("field NegativeCacheSize cannot be negative")
+	}
+	if c.PathCacheSize < 0 {
+		return fmt.Errorf("field PathCacheSize cannot be negative")
+	}
+	switch c.PathCachePolicy {
+	case "", CacheLRU, Cache2Q:
+	default:
+		return fmt.Errorf("unknown path cache policy %q", c.PathCachePolicy)
+	}
+	if c.CardinalityThreshold < 0 {
+		return fmt.Errorf("field CardinalityThreshold cannot be negative")
+	}
+	if c.CardinalityNodes < 0 {
+		return fmt.Errorf("field CardinalityNodes cannot be negative")
+	}
+	if c.UncertainConfidence < 0 || c.UncertainConfidence > 1 {
+		return fmt.Errorf("field UncertainConfidence must be between 0 and 1")
+	}
+	switch c.UncertainPolicy {
+	case "", UncertainModel, UncertainKeep, UncertainReplace:
+	default:
+		return fmt.Errorf("unknown uncertain policy %q", c.UncertainPolicy)
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("field Workers cannot be negative")
+	}
 	if c.MaxSegments > 100 {
 		return fmt.Errorf("field MaxSegments cannot be greater than 100")
 	}
@@ -48,6 +251,11 @@ func (c *Config) Validate() error {
 	if len(c.AdditionalValidChars) > 100 {
 		return fmt.Errorf("field AdditionalValidChars cannot have more than 100 characters")
 	}
+	for _, delim := range c.InnerDelimiters {
+		if delim == c.Separator {
+			return fmt.Errorf("field InnerDelimiters cannot contain the separator")
+		}
+	}
 
 	return nil
 }
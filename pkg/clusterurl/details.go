@@ -0,0 +1,128 @@
+package clusterurl
+
+import "strings"
+
+// Rules that can decide the fate of a segment. Custom rules are reported
+// with their own name.
+const (
+	// RuleEmpty is used for empty segments, which are always kept.
+	RuleEmpty = "empty"
+	// RuleInvalidChar is used for segments containing characters that are
+	// not valid in a word.
+	RuleInvalidChar = "invalid_char"
+	// RuleAllow is used for segments in the allow list.
+	RuleAllow = "allow"
+	// RuleDeny is used for segments in the deny list or matching a deny
+	// pattern.
+	RuleDeny = "deny"
+	// RuleIDShape is used for segments that look like a known kind of
+	// identifier, when TypedPlaceholders is enabled. Integers and UUIDs
+	// that reach the model are replaced by it too, without being scored.
+	RuleIDShape = "id_shape"
+	// RuleModel is used for segments classified by the gibberish model.
+	RuleModel = "model"
+	// RuleScript is used for segments written in a Unicode script that is
+	// not classified by the model, see Config.ScriptPolicies.
+	RuleScript = "script"
+	// RuleExtension is used for file names whose parts are classified
+	// separately from their extension, see Config.KeepExtensions.
+	RuleExtension = "extension"
+	// RulePartial is used for segments in which only some tokens were
+	// replaced, see Config.InnerDelimiters.
+	RulePartial = "partial"
+	// RuleRoute is used for segments matching a registered route template.
+	RuleRoute = "route"
+	// RuleUncertain is used for segments on which the gibberish model was
+	// not confident enough, see Config.UncertainConfidence.
+	RuleUncertain = "uncertain"
+	// RuleNone is used for segments on which every rule abstained, which
+	// are kept.
+	RuleNone = "none"
+	// RuleCardinality is used for segments replaced because too many
+	// distinct segments were seen after the same prefix, see
+	// Config.CardinalityThreshold.
+	RuleCardinality = "cardinality"
+	// RuleMaxSegments is used for segments dropped because the path has
+	// more than MaxSegments segments.
+	RuleMaxSegments = "max_segments"
+)
+
+// Details describes how a path was clustered.
+type Details struct {
+	// Input is the path as it was received.
+	Input string `json:"input"`
+	// Output is the clustered path, the same ClusterURL returns.
+	Output string `json:"output"`
+	// Method is the HTTP method preceding the path, if any.
+	Method string `json:"method,omitempty"`
+	// Scheme, UserInfo, Host and Port are the parts of an absolute URL
+	// preceding the path, before clustering.
+	Scheme   string `json:"scheme,omitempty"`
+	UserInfo string `json:"user_info,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     string `json:"port,omitempty"`
+	// Route is the registered route template matching the whole path, if any.
+	Route string `json:"route,omitempty"`
+	// Threshold is the gibberish threshold of the model in use, or of the
+	// model of Config.Language, or zero when it is a bundle of several
+	// models without a language hint.
+	Threshold float64 `json:"threshold"`
+	// Segments lists the segments of the path, including the dropped ones.
+	Segments []SegmentDetails `json:"segments"`
+	// Query lists the query string keys, when they are preserved.
+	Query []SegmentDetails `json:"query,omitempty"`
+}
+
+// SegmentDetails describes how a single segment was clustered.
+type SegmentDetails struct {
+	// Raw is the segment as it appears in the input.
+	Raw string `json:"raw"`
+	// Decoded is the percent-decoded segment, or the segment folded to
+	// ASCII before being scored, when it differs from Raw.
+	Decoded string `json:"decoded,omitempty"`
+	// Output is what the segment was turned into. It is empty for
+	// dropped segments.
+	Output string `json:"output"`
+	// Rule is the rule that decided whether to keep the segment.
+	Rule string `json:"rule"`
+	// Grace is true when an invalid character in second position was
+	// tolerated, as in "v1" or "k6".
+	Grace bool `json:"grace,omitempty"`
+	// Kind is the kind of identifier recognised in the segment, if any.
+	Kind string `json:"kind,omitempty"`
+	// Probability is the average transition probability computed by the
+	// gibberish model, or -1 when the model was not consulted.
+	Probability float64 `json:"probability"`
+	// Confidence is the confidence of the gibberish model in its verdict,
+	// between 0 and 1, or -1 when the model was not consulted.
+	Confidence float64 `json:"confidence"`
+	// Language is the language of the model of the bundle whose verdict
+	// was retained, see structs.GibberishBundle.
+	Language string `json:"language,omitempty"`
+}
+
+// addRoute records the segments of a path matching a route template.
+func (d *Details) addRoute(path, template string, sep byte) {
+	d.Route = template
+	templateSegs := strings.Split(template, string(sep))
+	for i, seg := range strings.Split(path, string(sep)) {
+		d.Segments = append(d.Segments, SegmentDetails{
+			Raw:         seg,
+			Output:      templateSegs[i],
+			Rule:        RuleRoute,
+			Probability: -1,
+			Confidence:  -1,
+		})
+	}
+}
+
+func (d *Details) addDropped(rest string, sep byte) {
+	for _, seg := range strings.Split(rest, string(sep)) {
+		d.Segments = append(d.Segments, SegmentDetails{
+			Raw:         seg,
+			Rule:        RuleMaxSegments,
+			Probability: -1,
+			Confidence:  -1,
+		})
+	}
+}
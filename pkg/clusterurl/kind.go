@@ -0,0 +1,172 @@
+package clusterurl
+
+// Kinds of identifiers recognised when Config.TypedPlaceholders is enabled.
+const (
+	KindInt   = "int"
+	KindUUID  = "uuid"
+	KindDate  = "date"
+	KindHash  = "hash"
+	KindULID  = "ulid"
+	KindToken = "token"
+)
+
+// minHashLen and minTokenLen are the shortest hex hashes and base62/base64
+// tokens recognised; shorter strings are too ambiguous.
+const (
+	minHashLen  = 8
+	minTokenLen = 16
+)
+
+// idKind returns the kind of identifier the segment looks like, or an empty
+// string if it does not match any known shape.
+func idKind(seg string) string {
+	switch {
+	case seg == "":
+		return ""
+	case isUUID(seg):
+		return KindUUID
+	case isDate(seg):
+		return KindDate
+	case isInt(seg):
+		return KindInt
+	case isHash(seg):
+		return KindHash
+	case isULID(seg):
+		return KindULID
+	case isToken(seg):
+		return KindToken
+	}
+
+	return ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isInt(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isUUID matches the canonical 8-4-4-4-12 representation.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHexDigit(s[i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isDate matches ISO 8601 calendar dates such as 2024-01-31.
+func isDate(s string) bool {
+	if len(s) != 10 || s[4] != '-' || s[7] != '-' {
+		return false
+	}
+	if !isInt(s[:4]) || !isInt(s[5:7]) || !isInt(s[8:]) {
+		return false
+	}
+	month := int(s[5]-'0')*10 + int(s[6]-'0')
+	day := int(s[8]-'0')*10 + int(s[9]-'0')
+
+	return month >= 1 && month <= 12 && day >= 1 && day <= 31
+}
+
+// isHash matches hex strings mixing letters and digits, like the digests
+// produced by MD5, SHA-1 or git.
+func isHash(s string) bool {
+	if len(s) < minHashLen {
+		return false
+	}
+	digits, letters := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case isDigit(s[i]):
+			digits++
+		case isHexDigit(s[i]):
+			letters++
+		default:
+			return false
+		}
+	}
+
+	return digits > 0 && letters > 0
+}
+
+// isULID matches 26 characters long Crockford base32 strings whose first
+// character fits in the 48 bits timestamp.
+func isULID(s string) bool {
+	if len(s) != 26 || s[0] < '0' || s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		switch {
+		case isDigit(c):
+		case c >= 'A' && c <= 'Z' && c != 'I' && c != 'L' && c != 'O' && c != 'U':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isToken matches base62 and base64 (standard or URL safe) tokens. Since
+// plain words are valid base64 too, a token must mix digits, lowercase and
+// uppercase letters.
+func isToken(s string) bool {
+	if len(s) < minTokenLen {
+		return false
+	}
+	s = trimPadding(s)
+	digits, lower, upper := false, false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case isDigit(c):
+			digits = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c == '+' || c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+
+	return digits && lower && upper
+}
+
+func trimPadding(s string) string {
+	for i := 0; i < 2 && len(s) > 0 && s[len(s)-1] == '='; i++ {
+		s = s[:len(s)-1]
+	}
+
+	return s
+}
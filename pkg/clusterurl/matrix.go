@@ -0,0 +1,82 @@
+package clusterurl
+
+import "strings"
+
+// MatrixMode defines what happens to the matrix parameters of a segment,
+// like in /item;color=red;size=9.
+type MatrixMode string
+
+const (
+	// MatrixOff does not recognise matrix parameters, so ';' and '=' are
+	// considered invalid characters. This is the default.
+	MatrixOff MatrixMode = "off"
+	// MatrixStrip removes the matrix parameters, e.g. /item.
+	MatrixStrip MatrixMode = "strip"
+	// MatrixWildcard keeps the parameter names and replaces their values,
+	// e.g. /item;color=*;size=*.
+	MatrixWildcard MatrixMode = "wildcard"
+)
+
+// sessionParams are well-known parameters carrying session identifiers,
+// which are always dropped.
+var sessionParams = []string{"jsessionid", "phpsessid", "sid"}
+
+// splitMatrixParams splits a segment into its base and its matrix
+// parameters, if matrix parameters are enabled.
+func (csf *ClusterURLClassifier) splitMatrixParams(seg string) (base string, params string) {
+	if csf.cfg.MatrixParams == "" || csf.cfg.MatrixParams == MatrixOff {
+		return seg, ""
+	}
+	if i := strings.IndexByte(seg, ';'); i >= 0 {
+		return seg[:i], seg[i+1:]
+	}
+
+	return seg, ""
+}
+
+// appendMatrixParams appends the matrix parameters that must be kept.
+func (csf *ClusterURLClassifier) appendMatrixParams(dst []byte, params string) []byte {
+	if csf.cfg.MatrixParams != MatrixWildcard {
+		return dst
+	}
+
+	for params != "" {
+		param := params
+		if i := strings.IndexByte(params, ';'); i >= 0 {
+			param, params = params[:i], params[i+1:]
+		} else {
+			params = ""
+		}
+
+		name, _, hasValue := strings.Cut(param, "=")
+		if name == "" || csf.isSessionParam(name) {
+			continue
+		}
+
+		dst = append(dst, ';')
+		dst = append(dst, name...)
+		if hasValue {
+			dst = append(dst, '=')
+			dst = csf.appendParam(dst, decision{}, func(dst []byte) []byte {
+				return append(dst, name...)
+			})
+		}
+	}
+
+	return dst
+}
+
+func (csf *ClusterURLClassifier) isSessionParam(name string) bool {
+	for _, p := range sessionParams {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	for _, p := range csf.cfg.SessionParams {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,43 @@
+package clusterurl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// standardMethods are the methods defined by RFC 9110, RFC 5789 and the
+// WebDAV RFC 4918.
+var standardMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// newMethodSet returns the set of the standard methods plus the custom ones.
+func newMethodSet(custom []string) (map[string]struct{}, error) {
+	methods := make(map[string]struct{}, len(standardMethods)+len(custom))
+	for _, m := range standardMethods {
+		methods[m] = struct{}{}
+	}
+	for _, m := range custom {
+		if m == "" || strings.ContainsAny(m, " /?&#") {
+			return nil, fmt.Errorf("newMethodSet: invalid method %q", m)
+		}
+		methods[m] = struct{}{}
+	}
+
+	return methods, nil
+}
+
+// splitMethod splits a leading HTTP method, like in "GET /users", from the
+// rest of the path. It returns an empty method if there is none.
+func (csf *ClusterURLClassifier) splitMethod(path string) (method string, rest string) {
+	end := strings.IndexByte(path, ' ')
+	if end <= 0 {
+		return "", path
+	}
+	if _, ok := csf.methods[path[:end]]; !ok {
+		return "", path
+	}
+
+	return path[:end], path[end+1:]
+}
@@ -0,0 +1,99 @@
+package clusterurl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Overrides are segments that are always kept or always replaced,
+// regardless of what the model thinks of them.
+type Overrides struct {
+	// Allow lists segments that are always kept, e.g. "k6" or "oauth2".
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists segments that are always replaced.
+	Deny []string `json:"deny,omitempty"`
+	// DenyPatterns are regular expressions matching segments that are
+	// always replaced. Patterns are not anchored.
+	DenyPatterns []string `json:"deny_patterns,omitempty"`
+}
+
+// LoadOverrides reads overrides from a JSON file.
+func LoadOverrides(path string) (*Overrides, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadOverrides: unable to read overrides: %w", err)
+	}
+
+	var o Overrides
+	if err := json.Unmarshal(content, &o); err != nil {
+		return nil, fmt.Errorf("LoadOverrides: unable to unmarshal overrides: %w", err)
+	}
+
+	return &o, nil
+}
+
+// overrideSet is the compiled form of Overrides.
+type overrideSet struct {
+	allow    map[string]struct{}
+	deny     map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// newOverrideSet compiles the given overrides. It returns nil if there is
+// nothing to override.
+func newOverrideSet(all ...*Overrides) (*overrideSet, error) {
+	set := &overrideSet{
+		allow: map[string]struct{}{},
+		deny:  map[string]struct{}{},
+	}
+	for _, o := range all {
+		if o == nil {
+			continue
+		}
+		for _, seg := range o.Allow {
+			set.allow[seg] = struct{}{}
+		}
+		for _, seg := range o.Deny {
+			set.deny[seg] = struct{}{}
+		}
+		for _, pattern := range o.DenyPatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("newOverrideSet: invalid deny pattern %q: %w", pattern, err)
+			}
+			set.patterns = append(set.patterns, re)
+		}
+	}
+
+	for seg := range set.allow {
+		if _, ok := set.deny[seg]; ok {
+			return nil, fmt.Errorf("newOverrideSet: segment %q is both allowed and denied", seg)
+		}
+	}
+
+	if len(set.allow) == 0 && len(set.deny) == 0 && len(set.patterns) == 0 {
+		return nil, nil
+	}
+
+	return set, nil
+}
+
+// lookup returns the rule overriding the segment, if any, and whether the
+// segment must be kept. Allowed segments win over deny patterns.
+func (set *overrideSet) lookup(seg string) (rule string, keep bool) {
+	if _, ok := set.allow[seg]; ok {
+		return RuleAllow, true
+	}
+	if _, ok := set.deny[seg]; ok {
+		return RuleDeny, false
+	}
+	for _, re := range set.patterns {
+		if re.MatchString(seg) {
+			return RuleDeny, false
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,171 @@
+package clusterurl
+
+import "strconv"
+
+// PlaceholderStyle defines how replaced segments are written.
+type PlaceholderStyle string
+
+const (
+	// StyleGlob writes the ReplaceWith character, e.g. /users/*.
+	StyleGlob PlaceholderStyle = "glob"
+	// StyleOpenAPI writes OpenAPI path templates, e.g. /users/{userId}.
+	StyleOpenAPI PlaceholderStyle = "openapi"
+	// StyleColon writes Express style parameters, e.g. /users/:userId.
+	StyleColon PlaceholderStyle = "colon"
+	// StyleCustom writes Config.Placeholder verbatim, e.g. /users/_.
+	StyleCustom PlaceholderStyle = "custom"
+)
+
+// defaultParamName names the placeholders that do not follow a static
+// segment.
+const defaultParamName = "id"
+
+// pathState carries what a segment needs to know about the ones
+// preceding it in the same path.
+type pathState struct {
+	// prev is the last segment kept verbatim, or empty if the previous
+	// segment was replaced.
+	prev string
+	// names are the parameter names already used in the path.
+	names []string
+	// index is the position of the current segment in the path.
+	index int
+	// last is true if the current segment is the last one of the path.
+	last bool
+	// route is the node of the known routes trie reached so far, or nil
+	// if the path does not follow any known route.
+	route *routeNode
+	// node is the node of the observed paths tree reached so far, or nil
+	// if the path is not learned.
+	node *prefixNode
+	// learn is true if the path is added to the observed paths tree,
+	// rather than only checked against it.
+	learn bool
+}
+
+// appendPlaceholder appends the text replacing a path segment.
+func (csf *ClusterURLClassifier) appendPlaceholder(dst []byte, dec decision, st *pathState) []byte {
+	return csf.appendParam(dst, dec, st.appendParamName)
+}
+
+// appendParam appends the text replacing a segment, using appendName to
+// write the parameter name when the style needs one.
+func (csf *ClusterURLClassifier) appendParam(dst []byte, dec decision, appendName func([]byte) []byte) []byte {
+	switch csf.cfg.PlaceholderStyle {
+	case StyleOpenAPI:
+		dst = append(dst, '{')
+		dst = appendName(dst)
+		return append(dst, '}')
+	case StyleColon:
+		dst = append(dst, ':')
+		return appendName(dst)
+	case StyleCustom:
+		return append(dst, csf.cfg.Placeholder...)
+	}
+
+	if !csf.cfg.TypedPlaceholders {
+		return append(dst, csf.cfg.ReplaceWith)
+	}
+	if dec.kind != "" {
+		dst = append(dst, '{')
+		dst = append(dst, dec.kind...)
+		return append(dst, '}')
+	}
+	if csf.cfg.FallbackPlaceholder != "" {
+		return append(dst, csf.cfg.FallbackPlaceholder...)
+	}
+
+	return append(dst, csf.cfg.ReplaceWith)
+}
+
+// appendParamName appends a parameter name derived from the preceding
+// static segment, e.g. "userId" after "users". Names are made unique
+// within the path by appending a counter.
+func (st *pathState) appendParamName(dst []byte) []byte {
+	start := len(dst)
+	if st.prev == "" {
+		dst = append(dst, defaultParamName...)
+	} else {
+		dst = appendCamelSingular(dst, st.prev)
+		dst = append(dst, "Id"...)
+	}
+
+	name := string(dst[start:])
+	n := 1
+	for _, used := range st.names {
+		if used == name {
+			n++
+		}
+	}
+	st.names = append(st.names, name)
+	if n > 1 {
+		dst = strconv.AppendInt(dst, int64(n), 10)
+	}
+
+	return dst
+}
+
+// appendCamelSingular appends the lower camel case, singular form of s.
+// Non alphanumeric characters separate the words, so "k6-test-runs"
+// becomes "k6TestRun".
+func appendCamelSingular(dst []byte, s string) []byte {
+	start := len(dst)
+	upper := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case isAlpha(c):
+			if len(dst) == start {
+				c = toLower(c)
+			} else if upper {
+				c = toUpper(c)
+			}
+			dst = append(dst, c)
+			upper = false
+		case isDigit(c):
+			dst = append(dst, c)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+
+	return singular(dst, start)
+}
+
+// singular strips the most common English plural suffixes from the last
+// word in dst[start:].
+func singular(dst []byte, start int) []byte {
+	w := dst[start:]
+	n := len(w)
+	switch {
+	case n > 4 && string(w[n-3:]) == "ies":
+		return append(dst[:len(dst)-3], 'y')
+	case n > 4 && (string(w[n-4:]) == "sses" || string(w[n-4:]) == "shes" || string(w[n-4:]) == "ches"):
+		return dst[:len(dst)-2]
+	case n > 3 && w[n-1] == 's' && w[n-2] != 's' && w[n-2] != 'u':
+		return dst[:len(dst)-1]
+	}
+
+	return dst
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
+func toUpper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+
+	return c
+}
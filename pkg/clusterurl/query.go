@@ -0,0 +1,89 @@
+package clusterurl
+
+import (
+	"sort"
+	"strings"
+)
+
+// QueryMode defines what happens to the query string of a path.
+type QueryMode string
+
+const (
+	// QueryStrip removes the query string. This is the default.
+	QueryStrip QueryMode = "strip"
+	// QueryDropValues keeps the query string keys and drops their values,
+	// e.g. /search?page&q.
+	QueryDropValues QueryMode = "drop_values"
+	// QueryWildcardValues keeps the query string keys and replaces their
+	// values, e.g. /search?page=*&q=*.
+	QueryWildcardValues QueryMode = "wildcard_values"
+)
+
+// queryKey is a query string key, after clustering.
+type queryKey struct {
+	// text is the key as it is written in the output.
+	text string
+	// name is the name of the parameter replacing the value.
+	name string
+}
+
+// appendQuery appends the sorted and deduplicated keys of the query string.
+// Keys are classified like path segments, so gibberish keys are replaced.
+func (csf *ClusterURLClassifier) appendQuery(dst []byte, query string, d *Details) []byte {
+	if end := strings.IndexByte(query, '#'); end >= 0 {
+		query = query[:end]
+	}
+
+	var keys []queryKey
+	for _, pair := range strings.FieldsFunc(query, isQuerySeparator) {
+		key := pair
+		if end := strings.IndexByte(pair, '='); end >= 0 {
+			key = pair[:end]
+		}
+		if key == "" {
+			continue
+		}
+
+		dec := csf.decide(key, &pathState{index: -1})
+		k := queryKey{text: key, name: key}
+		if !dec.keep {
+			k.text = string(csf.appendParam(nil, dec, appendQueryKeyName))
+			k.name = "value"
+		}
+		if d != nil {
+			d.Query = append(d.Query, csf.segmentDetails(key, k.text, dec))
+		}
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].text < keys[j].text
+	})
+
+	sep := byte('?')
+	for i, k := range keys {
+		if i > 0 && k.text == keys[i-1].text {
+			continue
+		}
+
+		dst = append(dst, sep)
+		dst = append(dst, k.text...)
+		if csf.cfg.Query == QueryWildcardValues {
+			dst = append(dst, '=')
+			dst = csf.appendParam(dst, decision{}, func(dst []byte) []byte {
+				return append(dst, k.name...)
+			})
+		}
+		sep = '&'
+	}
+
+	return dst
+}
+
+func isQuerySeparator(r rune) bool {
+	return r == '&' || r == '?' || r == ';'
+}
+
+func appendQueryKeyName(dst []byte) []byte {
+	return append(dst, "key"...)
+}
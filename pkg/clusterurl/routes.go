@@ -0,0 +1,112 @@
+package clusterurl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routeNode is a node of the trie holding the known route templates. Each
+// level of the trie matches a segment of the path.
+type routeNode struct {
+	// static holds the children matching a literal segment.
+	static map[string]*routeNode
+	// param is the child matching any segment, if any.
+	param *routeNode
+	// template is the route ending at this node, if any.
+	template string
+}
+
+// newRouteTrie builds the trie for the given route templates. It returns
+// nil if there are no templates.
+func newRouteTrie(templates []string, sep byte) (*routeNode, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+
+	root := &routeNode{}
+	for _, template := range templates {
+		if template == "" {
+			return nil, fmt.Errorf("newRouteTrie: empty route template")
+		}
+
+		node := root
+		for _, seg := range strings.Split(template, string(sep)) {
+			if isRouteParam(seg) {
+				if node.param == nil {
+					node.param = &routeNode{}
+				}
+				node = node.param
+				continue
+			}
+
+			if node.static == nil {
+				node.static = map[string]*routeNode{}
+			}
+			next, ok := node.static[seg]
+			if !ok {
+				next = &routeNode{}
+				node.static[seg] = next
+			}
+			node = next
+		}
+
+		if node.template != "" && node.template != template {
+			return nil, fmt.Errorf("newRouteTrie: route template %q conflicts with %q", template, node.template)
+		}
+		node.template = template
+	}
+
+	return root, nil
+}
+
+// isRouteParam tells whether a template segment is a parameter, written
+// as {name}, :name or *.
+func isRouteParam(seg string) bool {
+	switch {
+	case seg == "*":
+		return true
+	case len(seg) > 1 && seg[0] == ':':
+		return true
+	case len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}':
+		return true
+	}
+
+	return false
+}
+
+// match returns the template matching the whole path, preferring literal
+// segments over parameters.
+func (n *routeNode) match(path string, sep byte) (string, bool) {
+	end := strings.IndexByte(path, sep)
+	if end < 0 {
+		if next, ok := n.static[path]; ok && next.template != "" {
+			return next.template, true
+		}
+		if n.param != nil && n.param.template != "" && path != "" {
+			return n.param.template, true
+		}
+		return "", false
+	}
+
+	seg, rest := path[:end], path[end+1:]
+	if next, ok := n.static[seg]; ok {
+		if template, ok := next.match(rest, sep); ok {
+			return template, true
+		}
+	}
+	if n.param != nil && seg != "" {
+		return n.param.match(rest, sep)
+	}
+
+	return "", false
+}
+
+// next returns the node reached by following seg, and whether seg is a
+// literal segment of a known route.
+func (n *routeNode) next(seg string) (*routeNode, bool) {
+	if next, ok := n.static[seg]; ok {
+		return next, true
+	}
+
+	return n.param, false
+}
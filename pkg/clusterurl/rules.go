@@ -0,0 +1,282 @@
+package clusterurl
+
+import "fmt"
+
+// Verdict is the outcome of a SegmentRule.
+type Verdict int
+
+const (
+	// Abstain lets the next rule in the chain decide.
+	Abstain Verdict = iota
+	// Keep keeps the segment as is.
+	Keep
+	// Replace replaces the segment with a placeholder.
+	Replace
+)
+
+// Segment is a non-empty path segment being classified.
+type Segment struct {
+	// Text is the segment to classify. It is percent-decoded when
+	// Config.DecodePercent is set.
+	Text string
+	// Raw is the segment as it appears in the path.
+	Raw string
+	// Index is the position of the segment in the path, starting from 0
+	// for the text before the first separator. It is -1 for query string
+	// keys.
+	Index int
+}
+
+// SegmentRule decides whether a segment must be kept or replaced. Rules
+// are evaluated in the order of Config.Rules, and the first one that does
+// not abstain decides. Segments on which every rule abstains are kept.
+// Rules must be safe for concurrent use.
+type SegmentRule interface {
+	// Name identifies the rule in Details.
+	Name() string
+	// Evaluate returns the verdict of the rule for the segment.
+	Evaluate(seg Segment) Verdict
+}
+
+// builtinRule is a rule implemented by the classifier itself. In the chain
+// of its own classifier, it is bound to the classifier state, so that
+// Details report the whole decision, such as the kind of identifier.
+// Anywhere else, for example once wrapped in a custom rule, it is evaluated
+// like any other rule, against the current state of the classifier. The
+// rules without a classifier are bound to the one whose chain they are in.
+type builtinRule struct {
+	csf  *ClusterURLClassifier
+	name string
+}
+
+// The built-in rules, to mix with custom rules in Config.Rules. They are
+// bound to the classifier whose chain they are in, and abstain anywhere
+// else: the methods of the classifier return built-in rules that can be
+// evaluated on their own.
+var (
+	// BuiltinOverridesRule applies Config.Overrides and the overrides set
+	// with SetOverrides.
+	BuiltinOverridesRule SegmentRule = builtinRule{name: "overrides"}
+	// BuiltinIDShapeRule replaces segments that look like well-known kinds
+	// of identifiers, such as integers or UUIDs.
+	BuiltinIDShapeRule SegmentRule = builtinRule{name: RuleIDShape}
+	// BuiltinInvalidCharRule replaces segments containing characters that
+	// are not valid in a word.
+	BuiltinInvalidCharRule SegmentRule = builtinRule{name: RuleInvalidChar}
+	// BuiltinModelRule replaces segments that the gibberish model rejects
+	// and keeps the others. It never abstains.
+	BuiltinModelRule SegmentRule = builtinRule{name: RuleModel}
+)
+
+// OverridesRule returns the rule applying Config.Overrides and the
+// overrides set with SetOverrides.
+func (csf *ClusterURLClassifier) OverridesRule() SegmentRule {
+	return builtinRule{csf: csf, name: "overrides"}
+}
+
+// IDShapeRule returns the rule replacing segments that look like
+// well-known kinds of identifiers, such as integers or UUIDs.
+func (csf *ClusterURLClassifier) IDShapeRule() SegmentRule {
+	return builtinRule{csf: csf, name: RuleIDShape}
+}
+
+// InvalidCharRule returns the rule replacing segments containing
+// characters that are not valid in a word.
+func (csf *ClusterURLClassifier) InvalidCharRule() SegmentRule {
+	return builtinRule{csf: csf, name: RuleInvalidChar}
+}
+
+// ModelRule returns the rule replacing segments that the gibberish model
+// rejects and keeping the others. It never abstains.
+func (csf *ClusterURLClassifier) ModelRule() SegmentRule {
+	return builtinRule{csf: csf, name: RuleModel}
+}
+
+func (r builtinRule) Name() string {
+	return r.name
+}
+
+func (r builtinRule) Evaluate(seg Segment) Verdict {
+	if r.csf == nil {
+		return Abstain
+	}
+
+	bound := r.bind(r.csf.state.Load())
+	if bound == nil {
+		return Abstain
+	}
+
+	dec, ok := bound(seg)
+	switch {
+	case !ok:
+		return Abstain
+	case dec.keep:
+		return Keep
+	}
+	return Replace
+}
+
+// bind returns the rule bound to the state, or nil if it has nothing to
+// evaluate.
+func (r builtinRule) bind(st *state) boundRule {
+	csf := r.csf
+	switch r.name {
+	case RuleIDShape:
+		return idShapeRule
+	case RuleInvalidChar:
+		return func(seg Segment) (decision, bool) {
+			return csf.invalidCharRule(st, seg)
+		}
+	case RuleModel:
+		return func(seg Segment) (decision, bool) {
+			return csf.modelRule(st, seg)
+		}
+	}
+
+	if st.overrides == nil {
+		return nil
+	}
+	return st.overrides.rule
+}
+
+// NewSegmentRule returns a SegmentRule calling fn.
+func NewSegmentRule(name string, fn func(seg Segment) Verdict) SegmentRule {
+	return funcRule{name: name, fn: fn}
+}
+
+type funcRule struct {
+	name string
+	fn   func(seg Segment) Verdict
+}
+
+func (r funcRule) Name() string {
+	return r.name
+}
+
+func (r funcRule) Evaluate(seg Segment) Verdict {
+	return r.fn(seg)
+}
+
+// boundRule is a rule ready to be evaluated by the classifier. It returns
+// true if it decided the segment. The decision is returned by value rather
+// than filled through a pointer, so that it does not escape to the heap.
+type boundRule func(seg Segment) (decision, bool)
+
+// defaultRules returns the chain used when Config.Rules is not set.
+func (csf *ClusterURLClassifier) defaultRules() []SegmentRule {
+	if csf.cfg.TypedPlaceholders {
+		return []SegmentRule{BuiltinOverridesRule, BuiltinIDShapeRule, BuiltinInvalidCharRule, BuiltinModelRule}
+	}
+
+	return []SegmentRule{BuiltinOverridesRule, BuiltinInvalidCharRule, BuiltinModelRule}
+}
+
+// bindRules binds the built-in rules of the classifier, and the ones
+// without a classifier, to the state.
+func (csf *ClusterURLClassifier) bindRules(st *state, rules []SegmentRule) ([]boundRule, error) {
+	bound := make([]boundRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("bindRules: rule %d is nil", i)
+		}
+
+		if builtin, ok := rule.(builtinRule); ok && (builtin.csf == nil || builtin.csf == csf) {
+			builtin.csf = csf
+			if r := builtin.bind(st); r != nil {
+				bound = append(bound, r)
+			}
+			continue
+		}
+		bound = append(bound, customRule(rule))
+	}
+
+	return bound, nil
+}
+
+// Overrides are usually checked before the character table, otherwise
+// segments like "oauth2" could never be allowed.
+func (o *overrideSet) rule(seg Segment) (decision, bool) {
+	rule, keep := o.lookup(seg.Text)
+	if rule == "" {
+		return decision{}, false
+	}
+
+	return decision{rule: rule, keep: keep}, true
+}
+
+func idShapeRule(seg Segment) (decision, bool) {
+	kind := idKind(seg.Text)
+	if kind == "" {
+		return decision{}, false
+	}
+
+	return decision{rule: RuleIDShape, kind: kind}, true
+}
+
+// invalidCharRule reports the grace even when it abstains, so that it shows
+// in Details whichever rule decides.
+func (csf *ClusterURLClassifier) invalidCharRule(st *state, seg Segment) (decision, bool) {
+	invalid, grace := csf.invalidChar(st, seg.Text)
+	return decision{rule: RuleInvalidChar, grace: grace}, invalid
+}
+
+func (csf *ClusterURLClassifier) modelRule(st *state, seg Segment) (decision, bool) {
+	if !csf.cfg.Unicode || isASCII(seg.Text) {
+		return csf.modelDecision(st, seg.Text), true
+	}
+
+	switch csf.scriptPolicy(segmentScript(seg.Text)) {
+	case ScriptKeep:
+		return decision{rule: RuleScript, keep: true}, true
+	case ScriptReplace:
+		return decision{rule: RuleScript}, true
+	}
+
+	dec := csf.modelDecision(st, foldLatin(seg.Text))
+	return dec, true
+}
+
+func (csf *ClusterURLClassifier) modelDecision(st *state, text string) decision {
+	// Numbers and UUIDs are cheap to recognise, so they are replaced without
+	// asking the model: caching them would only evict other words.
+	if isInt(text) {
+		return decision{rule: RuleIDShape, kind: KindInt, text: text}
+	}
+	if isUUID(text) {
+		return decision{rule: RuleIDShape, kind: KindUUID, text: text}
+	}
+
+	keep, uncertain := csf.okWord(st, text)
+	if uncertain {
+		return decision{rule: RuleUncertain, keep: keep, text: text}
+	}
+
+	return decision{rule: RuleModel, keep: keep, text: text}
+}
+
+// UncertainPolicy defines what happens to the segments on which the model
+// is not confident enough, see Config.UncertainConfidence.
+type UncertainPolicy string
+
+const (
+	// UncertainModel follows the verdict of the model anyway. This is the
+	// default.
+	UncertainModel UncertainPolicy = "model"
+	// UncertainKeep keeps the segment.
+	UncertainKeep UncertainPolicy = "keep"
+	// UncertainReplace replaces the segment.
+	UncertainReplace UncertainPolicy = "replace"
+)
+
+func customRule(rule SegmentRule) boundRule {
+	name := rule.Name()
+	return func(seg Segment) (decision, bool) {
+		switch rule.Evaluate(seg) {
+		case Keep:
+			return decision{rule: name, keep: true}, true
+		case Replace:
+			return decision{rule: name}, true
+		}
+		return decision{}, false
+	}
+}
@@ -0,0 +1,133 @@
+package clusterurl
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ScriptPolicy defines how segments written in a given Unicode script are
+// classified when Config.Unicode is set.
+type ScriptPolicy string
+
+const (
+	// ScriptModel folds the segment to ASCII and classifies it with the
+	// model. This is the default for the Latin script.
+	ScriptModel ScriptPolicy = "model"
+	// ScriptKeep keeps the segment. This is the default for the scripts
+	// other than Latin, which the model cannot score.
+	ScriptKeep ScriptPolicy = "keep"
+	// ScriptReplace replaces the segment.
+	ScriptReplace ScriptPolicy = "replace"
+)
+
+// commonScripts are checked first when looking for the script of a rune,
+// before going through all the scripts known to the unicode package.
+var commonScripts = []string{
+	"Latin", "Cyrillic", "Greek", "Han", "Hiragana", "Katakana", "Hangul",
+	"Arabic", "Hebrew", "Devanagari", "Thai",
+}
+
+// latinFolding maps the most common lowercase Latin letters with
+// diacritics to their ASCII equivalent.
+var latinFolding = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i", 'į': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+func validateScriptPolicies(policies map[string]ScriptPolicy) error {
+	for script, policy := range policies {
+		if _, ok := unicode.Scripts[script]; !ok {
+			return fmt.Errorf("unknown Unicode script %q", script)
+		}
+		switch policy {
+		case ScriptModel, ScriptKeep, ScriptReplace:
+		default:
+			return fmt.Errorf("unknown policy %q for script %s", policy, script)
+		}
+	}
+
+	return nil
+}
+
+// isASCII tells whether s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isUnicodeLetter tells whether r is a letter, or a mark combined with one.
+func isUnicodeLetter(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r)
+}
+
+// segmentScript returns the script of the segment: the first script
+// other than Latin found in it, or Latin.
+func segmentScript(s string) string {
+	for _, r := range s {
+		if r < utf8.RuneSelf || !unicode.IsLetter(r) || unicode.Is(unicode.Latin, r) {
+			continue
+		}
+		if script := runeScript(r); script != "" {
+			return script
+		}
+	}
+
+	return "Latin"
+}
+
+func runeScript(r rune) string {
+	for _, script := range commonScripts {
+		if unicode.Is(unicode.Scripts[script], r) {
+			return script
+		}
+	}
+	for script, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return script
+		}
+	}
+
+	return ""
+}
+
+// scriptPolicy returns the policy for the given script.
+func (csf *ClusterURLClassifier) scriptPolicy(script string) ScriptPolicy {
+	if policy, ok := csf.cfg.ScriptPolicies[script]; ok {
+		return policy
+	}
+	if script == "Latin" {
+		return ScriptModel
+	}
+
+	return ScriptKeep
+}
+
+// foldLatin replaces the Latin letters with diacritics with their ASCII
+// equivalent, so that the model can score them.
+func foldLatin(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range strings.ToLower(s) {
+		if folded, ok := latinFolding[r]; ok {
+			b.WriteString(folded)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,384 @@
+package clusterurl
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/grafana/clusterurl/pkg/consts"
+	"github.com/grafana/clusterurl/pkg/gibberish"
+	"github.com/grafana/clusterurl/pkg/structs"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// CachePolicy is the eviction policy of the path cache.
+type CachePolicy string
+
+const (
+	// CacheLRU evicts the least recently used paths. This is the default.
+	CacheLRU CachePolicy = "lru"
+	// Cache2Q tracks the paths seen once apart from the paths seen
+	// repeatedly, so that a burst of unique paths does not evict the hot
+	// ones.
+	Cache2Q CachePolicy = "2q"
+)
+
+// CacheStats reports the activity of the path cache.
+type CacheStats struct {
+	// Hits is the number of paths found in the cache.
+	Hits uint64 `json:"hits"`
+	// Misses is the number of paths that had to be clustered.
+	Misses uint64 `json:"misses"`
+	// Len is the number of paths currently in the cache.
+	Len int `json:"len"`
+}
+
+// state is the part of the classifier that can be replaced while it is in
+// use. It is swapped as a whole, together with the caches depending on it,
+// so that a concurrent call can never store a verdict of the old model in
+// the caches of the new one.
+type state struct {
+	bundle *structs.GibberishBundle
+	// model and language are the only model of the bundle and its
+	// language, if it has a single one, so that it can be scored without
+	// iterating over the bundle.
+	model    *structs.GibberishData
+	language string
+	// hinted is the model of Config.Language in a bundle of several
+	// models, scored before the others.
+	hinted    *structs.GibberishData
+	cache     *lru.Cache[string, bool]
+	rejected  *lru.Cache[string, bool]
+	overrides *overrideSet
+	// validCharTable holds the characters allowed in words: the ones of
+	// the configuration and the ones added by the alphabet of the model.
+	validCharTable [256]bool
+	// rules is the chain as configured, kept to bind it again when the
+	// model or the overrides change.
+	rules []SegmentRule
+	bound []boundRule
+	paths *pathCache
+}
+
+// newState returns a state using the given model, word caches and
+// overrides, with a fresh path cache.
+func (csf *ClusterURLClassifier) newState(bundle *structs.GibberishBundle, cache, rejected *lru.Cache[string, bool], overrides *overrideSet, rules []SegmentRule) (*state, error) {
+	st := &state{
+		bundle:    bundle,
+		cache:     cache,
+		rejected:  rejected,
+		overrides: overrides,
+		rules:     rules,
+	}
+
+	if len(bundle.Models) == 1 {
+		for language, data := range bundle.Models {
+			st.language, st.model = language, data
+		}
+	} else if data, ok := bundle.Models[csf.cfg.Language]; ok {
+		st.language, st.hinted = csf.cfg.Language, data
+	}
+
+	// A model trained with digits or punctuation can score the segments
+	// containing them. The default alphabet is left to the configuration.
+	st.validCharTable = csf.validCharTable
+	for _, data := range bundle.Models {
+		for _, r := range data.AcceptedCharacters() {
+			if r < utf8.RuneSelf && !strings.ContainsRune(consts.AcceptedCharacters, r) {
+				st.validCharTable[r] = true
+				st.validCharTable[toUpper(byte(r))] = true
+			}
+		}
+	}
+
+	var err error
+	if rules == nil {
+		rules = csf.defaultRules()
+	}
+	st.bound, err = csf.bindRules(st, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	st.paths, err = newPathCache(csf.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// newWordCaches returns the caches of the model verdicts.
+func newWordCaches(config *Config) (cache, rejected *lru.Cache[string, bool], err error) {
+	cache, err = lru.New[string, bool](config.CacheSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create cache: %w", err)
+	}
+
+	// The rejected words have their own cache, so that a flood of unique
+	// IDs cannot evict the known words.
+	if config.NegativeCacheSize > 0 {
+		rejected, err = lru.New[string, bool](config.NegativeCacheSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create negative cache: %w", err)
+		}
+	}
+
+	return cache, rejected, nil
+}
+
+// SetOverrides replaces the overrides of the classifier, including the ones
+// read from Config.OverridesPath. The path cache is cleared.
+func (csf *ClusterURLClassifier) SetOverrides(o *Overrides) error {
+	overrides, err := newOverrideSet(o)
+	if err != nil {
+		return fmt.Errorf("SetOverrides: invalid overrides: %w", err)
+	}
+
+	csf.mu.Lock()
+	defer csf.mu.Unlock()
+
+	old := csf.state.Load()
+	st, err := csf.newState(old.bundle, old.cache, old.rejected, overrides, old.rules)
+	if err != nil {
+		return fmt.Errorf("SetOverrides: %w", err)
+	}
+	csf.state.Store(st)
+
+	return nil
+}
+
+// SetRules replaces the chain of rules classifying each segment, as
+// described in Config.Rules. A nil chain restores the default one. The path
+// cache is cleared.
+func (csf *ClusterURLClassifier) SetRules(rules []SegmentRule) error {
+	csf.mu.Lock()
+	defer csf.mu.Unlock()
+
+	old := csf.state.Load()
+	st, err := csf.newState(old.bundle, old.cache, old.rejected, old.overrides, rules)
+	if err != nil {
+		return fmt.Errorf("SetRules: invalid rules: %w", err)
+	}
+	csf.state.Store(st)
+
+	return nil
+}
+
+// SetModel replaces the gibberish model of the classifier. All the caches
+// are cleared, since they hold the verdicts of the previous model.
+func (csf *ClusterURLClassifier) SetModel(classifier *structs.GibberishData) error {
+	if classifier == nil {
+		return fmt.Errorf("SetModel: model is nil")
+	}
+
+	bundle := &structs.GibberishBundle{Models: map[string]*structs.GibberishData{"": classifier}}
+	if err := csf.setBundle(bundle); err != nil {
+		return fmt.Errorf("SetModel: %w", err)
+	}
+
+	return nil
+}
+
+// SetBundle replaces the gibberish models of the classifier with a bundle,
+// which must have a model for Config.Language if it is set. All the caches
+// are cleared, since they hold the verdicts of the previous models.
+func (csf *ClusterURLClassifier) SetBundle(bundle *structs.GibberishBundle) error {
+	if bundle == nil {
+		return fmt.Errorf("SetBundle: bundle is nil")
+	}
+
+	if err := checkLanguage(bundle, csf.cfg.Language); err != nil {
+		return fmt.Errorf("SetBundle: %w", err)
+	}
+	if err := csf.setBundle(bundle); err != nil {
+		return fmt.Errorf("SetBundle: %w", err)
+	}
+
+	return nil
+}
+
+func (csf *ClusterURLClassifier) setBundle(bundle *structs.GibberishBundle) error {
+	if err := bundle.Validate(); err != nil {
+		return fmt.Errorf("invalid model: %w", err)
+	}
+
+	cache, rejected, err := newWordCaches(csf.cfg)
+	if err != nil {
+		return err
+	}
+
+	csf.mu.Lock()
+	defer csf.mu.Unlock()
+
+	old := csf.state.Load()
+	st, err := csf.newState(bundle, cache, rejected, old.overrides, old.rules)
+	if err != nil {
+		return err
+	}
+	csf.state.Store(st)
+
+	return nil
+}
+
+// threshold returns the threshold of the model, or of the hinted one, or
+// zero for a bundle of several models without a hint.
+func (st *state) threshold() float64 {
+	switch {
+	case st.model != nil:
+		return st.model.Threshold
+	case st.hinted != nil:
+		return st.hinted.Threshold
+	}
+
+	return 0
+}
+
+// score scores the word against the models, and returns the language of
+// the model that decided. The hinted model decides unless it rejects the
+// word and another model accepts it.
+func (st *state) score(w string) (string, gibberish.Result) {
+	if st.model != nil {
+		return st.language, gibberish.Score(w, st.model)
+	}
+	if st.hinted == nil {
+		return gibberish.ScoreBundle(w, st.bundle)
+	}
+
+	hinted := gibberish.Score(w, st.hinted)
+	if !hinted.Gibberish() {
+		return st.language, hinted
+	}
+	if language, result := gibberish.ScoreBundle(w, st.bundle); !result.Gibberish() {
+		return language, result
+	}
+
+	return st.language, hinted
+}
+
+// PathCacheStats returns the hit and miss counters of the path cache since
+// the classifier was created. They are zero when the cache is disabled.
+func (csf *ClusterURLClassifier) PathCacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:   csf.pathHits.Load(),
+		Misses: csf.pathMisses.Load(),
+	}
+	if paths := csf.state.Load().paths; paths != nil {
+		stats.Len = paths.len()
+	}
+
+	return stats
+}
+
+// pathCache caches whole clustered paths, with either eviction policy.
+type pathCache struct {
+	lru      *lru.Cache[string, string]
+	twoQueue *lru.TwoQueueCache[string, string]
+}
+
+// newPathCache returns the path cache described by the configuration, or
+// nil if it is disabled.
+func newPathCache(config *Config) (*pathCache, error) {
+	if config.PathCacheSize == 0 {
+		return nil, nil
+	}
+
+	var c pathCache
+	var err error
+	if config.PathCachePolicy == Cache2Q {
+		c.twoQueue, err = lru.New2Q[string, string](config.PathCacheSize)
+	} else {
+		c.lru, err = lru.New[string, string](config.PathCacheSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create path cache: %w", err)
+	}
+
+	return &c, nil
+}
+
+func (c *pathCache) get(key string) (string, bool) {
+	if c.twoQueue != nil {
+		return c.twoQueue.Get(key)
+	}
+
+	return c.lru.Get(key)
+}
+
+func (c *pathCache) add(key, value string) {
+	if c.twoQueue != nil {
+		c.twoQueue.Add(key, value)
+		return
+	}
+
+	c.lru.Add(key, value)
+}
+
+func (c *pathCache) remove(key string) {
+	if c.twoQueue != nil {
+		c.twoQueue.Remove(key)
+		return
+	}
+
+	c.lru.Remove(key)
+}
+
+func (c *pathCache) purge() {
+	if c.twoQueue != nil {
+		c.twoQueue.Purge()
+		return
+	}
+
+	c.lru.Purge()
+}
+
+func (c *pathCache) len() int {
+	if c.twoQueue != nil {
+		return c.twoQueue.Len()
+	}
+
+	return c.lru.Len()
+}
+
+// pathCacheKey returns the key of the path in the path cache. The query
+// string is left out when it is stripped from the result anyway. Only "?"
+// and "#" are considered, since they end the authority of absolute URLs
+// too.
+func (csf *ClusterURLClassifier) pathCacheKey(path string) string {
+	if csf.cfg.Query != "" && csf.cfg.Query != QueryStrip {
+		return path
+	}
+
+	if end := strings.IndexAny(path, "?#"); end >= 0 {
+		return path[:end]
+	}
+
+	return path
+}
+
+// storePath caches the clustered path, unless a prefix collapsed since the
+// generation was read, in which case the path may have been clustered with
+// the segments that were collapsed. The generation is checked again once the
+// path is cached, since a collapse may purge the cache in between.
+func (csf *ClusterURLClassifier) storePath(paths *pathCache, key, out string, generation uint64) {
+	if csf.generation() != generation {
+		return
+	}
+
+	paths.add(key, out)
+	if csf.generation() != generation {
+		paths.remove(key)
+	}
+}
+
+// lookupPath looks the key up in the path cache, counting hits and misses.
+func (csf *ClusterURLClassifier) lookupPath(paths *pathCache, key string) (string, bool) {
+	out, ok := paths.get(key)
+	if ok {
+		csf.pathHits.Add(1)
+	} else {
+		csf.pathMisses.Add(1)
+	}
+
+	return out, ok
+}
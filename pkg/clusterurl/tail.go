@@ -0,0 +1,79 @@
+package clusterurl
+
+import "strings"
+
+// TailPolicy defines what happens to paths with more than MaxSegments
+// segments.
+type TailPolicy string
+
+const (
+	// TailDrop keeps the first MaxSegments segments and silently drops the
+	// others. This is the default.
+	TailDrop TailPolicy = "drop"
+	// TailMarker keeps the first MaxSegments segments and replaces the
+	// others with TailMarker, e.g. /a/b/**.
+	TailMarker TailPolicy = "marker"
+	// TailKeepLast keeps the first segment, which is empty for paths
+	// starting with the separator, and the last MaxSegments-1 segments,
+	// e.g. /k/l. They are separated by TailMarker, if set. MaxSegments
+	// must be at least 2.
+	TailKeepLast TailPolicy = "keep_last"
+	// TailWildcard keeps the first MaxSegments segments and replaces the
+	// others with a single placeholder, e.g. /a/b/*. Unlike TailMarker, the
+	// tail is written like a replaced segment, in the PlaceholderStyle, so
+	// that the output is still a route template, e.g. /users/{userId}.
+	// The first segments are classified like any other, so they may be
+	// replaced too.
+	TailWildcard TailPolicy = "wildcard"
+)
+
+// appendTail appends what replaces the segments beyond MaxSegments.
+func (csf *ClusterURLClassifier) appendTail(dst []byte, rest string, st *pathState, d *Details) []byte {
+	if d != nil {
+		d.addDropped(rest, csf.cfg.Separator)
+	}
+
+	switch csf.cfg.TailPolicy {
+	case TailMarker:
+		dst = append(dst, csf.cfg.Separator)
+		dst = append(dst, csf.cfg.TailMarker...)
+	case TailWildcard:
+		dst = append(dst, csf.cfg.Separator)
+		dst = csf.appendPlaceholder(dst, decision{rule: RuleMaxSegments}, st)
+	}
+
+	return dst
+}
+
+// clusterLastSegments appends the first segment of path and its last
+// MaxSegments-1 segments.
+func (csf *ClusterURLClassifier) clusterLastSegments(dst []byte, path string, st *pathState, d *Details) []byte {
+	sep := csf.cfg.Separator
+	skip := strings.Count(path, string(sep)) + 1 - csf.cfg.MaxSegments
+	if skip <= 0 {
+		return csf.clusterSegments(dst, path, st, d)
+	}
+
+	end := strings.IndexByte(path, sep)
+	dst = csf.appendSegment(dst, path[:end], st, d)
+	dst = append(dst, sep)
+	if csf.cfg.TailMarker != "" {
+		dst = append(dst, csf.cfg.TailMarker...)
+		dst = append(dst, sep)
+	}
+
+	// The skipped segments break any known route.
+	rest := path[end+1:]
+	cut := 0
+	for i := 0; i < skip; i++ {
+		cut += strings.IndexByte(rest[cut:], sep) + 1
+	}
+	if d != nil {
+		d.addDropped(rest[:cut-1], sep)
+	}
+	st.route = nil
+	st.prev = ""
+	st.index += 1 + skip
+
+	return csf.clusterSegments(dst, rest[cut:], st, d)
+}
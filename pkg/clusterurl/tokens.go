@@ -0,0 +1,104 @@
+package clusterurl
+
+import (
+	"bytes"
+	"strings"
+)
+
+// extensionDelims separate the parts of a file name.
+var extensionDelims = []byte{'.'}
+
+// defaultExtensions are the file extensions recognised when
+// Config.KeepExtensions is set.
+var defaultExtensions = []string{
+	"js", "mjs", "css", "map", "html", "htm", "json", "xml", "txt", "csv", "pdf",
+	"png", "jpg", "jpeg", "gif", "svg", "ico", "webp", "avif", "bmp",
+	"woff", "woff2", "ttf", "otf", "eot",
+	"mp3", "mp4", "webm", "ogg", "wav", "wasm", "zip", "gz", "tar",
+}
+
+// heuristic tells whether the decision was taken by one of the built-in
+// heuristics, as opposed to an explicit override, route or custom rule.
+func (dec decision) heuristic() bool {
+	switch dec.rule {
+	case RuleIDShape, RuleInvalidChar, RuleModel, RuleUncertain, RuleScript:
+		return true
+	}
+
+	return false
+}
+
+// extension returns the recognised file extension of the segment,
+// including the dot, or an empty string.
+func (csf *ClusterURLClassifier) extension(seg string) string {
+	dot := strings.LastIndexByte(seg, '.')
+	if dot <= 0 {
+		return ""
+	}
+
+	ext := seg[dot+1:]
+	for _, known := range defaultExtensions {
+		if strings.EqualFold(ext, known) {
+			return seg[dot:]
+		}
+	}
+	for _, known := range csf.cfg.Extensions {
+		if strings.EqualFold(ext, strings.TrimPrefix(known, ".")) {
+			return seg[dot:]
+		}
+	}
+
+	return ""
+}
+
+// appendTokens appends s after classifying each of its tokens separately,
+// tokens being separated by any of the delimiters. Consecutive dynamic
+// tokens, along with the delimiters between them, are replaced by a single
+// placeholder: "app.3f9a.8c1d" becomes "app.*". It also reports whether
+// any non-empty token was kept.
+func (csf *ClusterURLClassifier) appendTokens(dst []byte, s string, delims []byte, st *pathState) ([]byte, bool) {
+	kept := false
+	dynamic := false
+	delim := ""
+	for {
+		end := tokenEnd(s, delims)
+		token := s[:end]
+
+		dec := csf.decide(token, &pathState{index: st.index})
+		switch {
+		case dec.keep:
+			dst = append(dst, delim...)
+			dst = append(dst, token...)
+			kept = kept || token != ""
+			dynamic = false
+		case !dynamic:
+			dst = append(dst, delim...)
+			dst = csf.appendPlaceholder(dst, dec, st)
+			dynamic = true
+		}
+
+		if end == len(s) {
+			return dst, kept
+		}
+		delim, s = s[end:end+1], s[end+1:]
+	}
+}
+
+// tokenEnd returns the index of the first delimiter in s, or its length.
+// Alphanumeric delimiters, like the 'x' in "640x480", only separate digits.
+func tokenEnd(s string, delims []byte) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if bytes.IndexByte(delims, c) < 0 {
+			continue
+		}
+		if isAlpha(c) || isDigit(c) {
+			if i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1]) {
+				continue
+			}
+		}
+		return i
+	}
+
+	return len(s)
+}
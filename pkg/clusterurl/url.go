@@ -0,0 +1,139 @@
+package clusterurl
+
+import "strings"
+
+// urlPrefix holds the parts of an absolute URL preceding the path.
+type urlPrefix struct {
+	scheme   string
+	userInfo string
+	host     string
+	port     string
+}
+
+// splitAbsoluteURL splits an absolute URL like
+// "https://user@api.example.com:8443/users/42" into the parts preceding
+// the path, and the rest. It returns false if s is not an absolute URL.
+func splitAbsoluteURL(s string) (urlPrefix, string, bool) {
+	var p urlPrefix
+
+	end := strings.Index(s, "://")
+	if end <= 0 || !isScheme(s[:end]) {
+		return p, s, false
+	}
+	p.scheme = s[:end]
+	s = s[end+3:]
+
+	end = strings.IndexAny(s, "/?#")
+	if end < 0 {
+		end = len(s)
+	}
+	authority, rest := s[:end], s[end:]
+
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		p.userInfo, authority = authority[:at], authority[at+1:]
+	}
+
+	// The port follows the last colon, unless it is part of an IPv6 address.
+	if colon := strings.LastIndexByte(authority, ':'); colon >= 0 && !strings.Contains(authority[colon:], "]") {
+		p.host, p.port = authority[:colon], authority[colon+1:]
+	} else {
+		p.host = authority
+	}
+
+	return p, rest, true
+}
+
+// isScheme tells whether s is a valid URL scheme, as defined in RFC 3986.
+func isScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case isAlpha(c):
+		case i > 0 && (isDigit(c) || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// appendURLPrefix appends the parts of the URL prefix that must be kept.
+// The user info and the port are only kept along with the host.
+func (csf *ClusterURLClassifier) appendURLPrefix(dst []byte, p urlPrefix, d *Details) []byte {
+	if d != nil {
+		d.Scheme, d.UserInfo, d.Host, d.Port = p.scheme, p.userInfo, p.host, p.port
+	}
+
+	if csf.cfg.KeepScheme {
+		dst = append(dst, p.scheme...)
+		dst = append(dst, "://"...)
+	}
+	if !csf.cfg.KeepHost {
+		return dst
+	}
+
+	if csf.cfg.KeepUserInfo && p.userInfo != "" {
+		dst = append(dst, p.userInfo...)
+		dst = append(dst, '@')
+	}
+	if csf.cfg.ClusterHost {
+		dst = csf.appendHost(dst, p.host)
+	} else {
+		dst = append(dst, p.host...)
+	}
+	if csf.cfg.KeepPort && p.port != "" {
+		dst = append(dst, ':')
+		dst = append(dst, p.port...)
+	}
+
+	return dst
+}
+
+// appendHost appends the clustered host name. The labels are classified
+// like path segments, except for the registrable domain and the top-level
+// domain, which are always kept: tenant-8f3a.example.com becomes
+// *.example.com. IP addresses are kept as they are.
+func (csf *ClusterURLClassifier) appendHost(dst []byte, host string) []byte {
+	if isIPAddress(host) {
+		return append(dst, host...)
+	}
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if i > 0 {
+			dst = append(dst, '.')
+		}
+		if i >= len(labels)-2 || label == "www" {
+			dst = append(dst, label...)
+			continue
+		}
+
+		dec := csf.decide(label, &pathState{index: -1})
+		if dec.keep {
+			dst = append(dst, label...)
+		} else {
+			dst = csf.appendParam(dst, dec, appendHostLabelName)
+		}
+	}
+
+	return dst
+}
+
+// isIPAddress tells whether host is an IPv4 or a bracketed IPv6 address.
+func isIPAddress(host string) bool {
+	if strings.HasPrefix(host, "[") {
+		return true
+	}
+	for i := 0; i < len(host); i++ {
+		if !isDigit(host[i]) && host[i] != '.' {
+			return false
+		}
+	}
+
+	return host != ""
+}
+
+func appendHostLabelName(dst []byte) []byte {
+	return append(dst, "subdomain"...)
+}
@@ -10,13 +10,130 @@
 package gibberish
 
 import (
+	"math"
+
 	"github.com/grafana/clusterurl/pkg/analysis"
 	"github.com/grafana/clusterurl/pkg/structs"
 )
 
+// defaultSpread is the spread of the models trained before
+// it was measured. Unlike the spread of newer models, it is a
+// rough estimate, so their confidence is not calibrated.
+const defaultSpread = 1.5
+
+// Result is the detailed outcome of the gibberish detection.
+type Result struct {
+	// Probability is the average transition probability of
+	// the input.
+	Probability float64
+	// Threshold is the probability at or under which the
+	// input is gibberish.
+	Threshold float64
+	// Margin is the distance between the probability and the
+	// threshold, in log space. It is negative for gibberish.
+	Margin float64
+	// Digraphs is the number of transitions that were scored.
+	Digraphs int
+	// Err is set when the input could not be scored, for
+	// example because the model does not know one of its
+	// characters.
+	Err error
+	// Confidence tells how reliable the verdict is, from 0
+	// for inputs right on the threshold, or that could not be
+	// scored, to 1.
+	Confidence float64
+}
+
+// Gibberish tells whether the input is likely to be
+// gibberish. Inputs that could not be scored are not.
+func (r Result) Gibberish() bool {
+
+	return r.Err == nil && r.Probability <= r.Threshold
+
+}
+
+// Score scores the input against the model.
+//
+// The confidence assumes that the log probabilities of the
+// transitions are independent, with the spread measured when
+// the model was trained, so that their average gets closer
+// to the true one as the input gets longer: short inputs,
+// and inputs close to the threshold, are uncertain.
+func Score(input string, data *structs.GibberishData) Result {
+
+	result := Result{Threshold: data.Threshold}
+	result.Probability, result.Digraphs, result.Err = analysis.AverageNGramProbability(input, data)
+	if result.Err != nil {
+		return result
+	}
+
+	if result.Probability > 0 && result.Threshold > 0 {
+		result.Margin = math.Log(result.Probability / result.Threshold)
+	}
+
+	spread := data.Spread
+	if spread == 0 {
+		spread = defaultSpread
+	}
+
+	z := math.Abs(result.Margin) * math.Sqrt(float64(result.Digraphs)) / spread
+	result.Confidence = math.Erf(z / math.Sqrt2)
+
+	return result
+
+}
+
 // IsGibberish returns true if the input string is likely
-// to be gibberish
+// to be gibberish. It is the same as Score(...).Gibberish(),
+// without computing the confidence.
 func IsGibberish(input string, data *structs.GibberishData) bool {
-	value, err := analysis.AverageTransitionProbability(input, data.Occurrences, data.Positions)
-	return value <= data.Threshold && err == nil
+
+	probability, _, err := analysis.AverageNGramProbability(input, data)
+	return err == nil && probability <= data.Threshold
+
+}
+
+// ScoreBundle scores the input against every model of the
+// bundle. It returns the language of the model that accepts
+// the input with the largest margin or, if all the models
+// find it gibberish, the one that rejects it with the
+// smallest margin, along with its result. Ties are broken by
+// the name of the language, so that the outcome does not
+// depend on the order of the models.
+func ScoreBundle(input string, bundle *structs.GibberishBundle) (string, Result) {
+
+	var bestLanguage string
+	var best Result
+	found := false
+
+	for language, data := range bundle.Models {
+
+		result := Score(input, data)
+		if found && !better(result, language, best, bestLanguage) {
+			continue
+		}
+
+		bestLanguage, best, found = language, result, true
+
+	}
+
+	return bestLanguage, best
+
+}
+
+// better tells whether the result a is better than the
+// result b: inputs that could be scored first, then the
+// largest margin, then the first language.
+func better(a Result, aLanguage string, b Result, bLanguage string) bool {
+
+	if (a.Err == nil) != (b.Err == nil) {
+		return a.Err == nil
+	}
+
+	if a.Margin != b.Margin {
+		return a.Margin > b.Margin
+	}
+
+	return aLanguage < bLanguage
+
 }
@@ -54,6 +54,83 @@ func LoadKnowledgeBase(fileName string) (*structs.GibberishData, error) {
 		return nil, fmt.Errorf("LoadKnowledgeBase: unable to unmarshal knowledge base content: %s", err)
 	}
 
+	err = data.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("LoadKnowledgeBase: invalid knowledge base: %s", err)
+	}
+
 	return &data, nil
 
 }
+
+// WriteBundle writes a bundle of gibberish models to disk.
+func WriteBundle(bundle *structs.GibberishBundle, outputFileName string) error {
+
+	toWrite, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("WriteBundle: unable to marshal the bundle: %s", err)
+	}
+
+	err = ioutil.WriteFile(outputFileName, toWrite, 0644)
+	if err != nil {
+		return fmt.Errorf("WriteBundle: unable to save the bundle on disk: %s", err)
+	}
+
+	return nil
+
+}
+
+// LoadBundle loads a bundle of gibberish models from disk.
+// A file holding a single model is loaded as a bundle whose
+// only model has an empty language.
+func LoadBundle(fileName string) (*structs.GibberishBundle, error) {
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("LoadBundle: unable to read the bundle: %s", err)
+	}
+
+	bundle, err := UnmarshalBundle(content)
+	if err != nil {
+		return nil, fmt.Errorf("LoadBundle: %s", err)
+	}
+
+	return bundle, nil
+
+}
+
+// UnmarshalBundle decodes either a bundle of gibberish models
+// or a single model, which becomes a bundle whose only model
+// has an empty language, and validates it.
+func UnmarshalBundle(content []byte) (*structs.GibberishBundle, error) {
+
+	// Bundles are told apart from single models by the field
+	// holding their models.
+	var probe struct {
+		Models json.RawMessage
+	}
+	err := json.Unmarshal(content, &probe)
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalBundle: unable to unmarshal the content: %s", err)
+	}
+
+	var bundle structs.GibberishBundle
+	if probe.Models != nil {
+		err = json.Unmarshal(content, &bundle)
+	} else {
+		var data structs.GibberishData
+		err = json.Unmarshal(content, &data)
+		bundle.Models = map[string]*structs.GibberishData{"": &data}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalBundle: unable to unmarshal the content: %s", err)
+	}
+
+	err = bundle.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalBundle: invalid bundle: %s", err)
+	}
+
+	return &bundle, nil
+
+}
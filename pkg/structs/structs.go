@@ -9,6 +9,15 @@
 // of the structures used.
 package structs
 
+import (
+	"fmt"
+	"math"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/grafana/clusterurl/pkg/consts"
+)
+
 // Digraph represents a two-dimensional
 // n-gram.
 type Digraph struct {
@@ -22,4 +31,130 @@ type GibberishData struct {
 	Occurrences [][]float64
 	Positions   map[rune]int
 	Threshold   float64
+	// Order is the length of the n-grams of the model.
+	// Models without it are bigram models.
+	Order int `json:",omitempty"`
+	// Contexts holds, for models of order 3 or more, the
+	// log probabilities of the runes following contexts
+	// longer than a single rune, indexed by Positions.
+	// Contexts seen too rarely during the training are
+	// left out, and back off to shorter ones.
+	Contexts map[string][]float64 `json:",omitempty"`
+	// Alphabet holds the runes known by the model, in the
+	// order of their positions. Inputs are lowercased and
+	// stripped of the other runes before being scored.
+	// Models without it use consts.AcceptedCharacters.
+	Alphabet string `json:",omitempty"`
+	// Spread is the standard deviation of the log
+	// probabilities of the transitions of an input around
+	// their average, measured on the good and bad inputs when
+	// the model is trained. It calibrates the confidence of
+	// the scores.
+	Spread float64 `json:",omitempty"`
+}
+
+// AcceptedCharacters returns the alphabet of the model.
+func (d *GibberishData) AcceptedCharacters() string {
+
+	if d.Alphabet == "" {
+		return consts.AcceptedCharacters
+	}
+
+	return d.Alphabet
+
+}
+
+// NGramOrder returns the length of the n-grams of the
+// model, which is 2 for models without an order.
+func (d *GibberishData) NGramOrder() int {
+
+	if d.Order == 0 {
+		return 2
+	}
+
+	return d.Order
+
+}
+
+// Validate checks that the model is consistent, so that
+// scoring an input cannot fail on a malformed model.
+func (d *GibberishData) Validate() error {
+
+	if d.Order < 0 || d.Order == 1 {
+		return fmt.Errorf("Validate: invalid order %d", d.Order)
+	}
+
+	if d.Spread < 0 || math.IsNaN(d.Spread) || math.IsInf(d.Spread, 0) {
+		return fmt.Errorf("Validate: invalid spread %v", d.Spread)
+	}
+
+	alphabet := d.AcceptedCharacters()
+	if utf8.RuneCountInString(alphabet) != len(d.Positions) {
+		return fmt.Errorf("Validate: %d positions for an alphabet of %d runes", len(d.Positions), utf8.RuneCountInString(alphabet))
+	}
+
+	index := 0
+	for _, r := range alphabet {
+		if r == utf8.RuneError || unicode.ToLower(r) != r {
+			return fmt.Errorf("Validate: invalid rune %q in the alphabet", r)
+		}
+		position, found := d.Positions[r]
+		if !found || position != index {
+			return fmt.Errorf("Validate: the rune %q of the alphabet is not at position %d", r, index)
+		}
+		index++
+	}
+
+	if len(d.Occurrences) != len(d.Positions) {
+		return fmt.Errorf("Validate: %d rows of occurrences for %d positions", len(d.Occurrences), len(d.Positions))
+	}
+
+	for _, row := range d.Occurrences {
+		if len(row) != len(d.Positions) {
+			return fmt.Errorf("Validate: %d occurrences in a row for %d positions", len(row), len(d.Positions))
+		}
+	}
+
+	for context, row := range d.Contexts {
+		length := utf8.RuneCountInString(context)
+		if length < 2 || length >= d.NGramOrder() {
+			return fmt.Errorf("Validate: context %q does not fit a model of order %d", context, d.NGramOrder())
+		}
+		if len(row) != len(d.Positions) {
+			return fmt.Errorf("Validate: %d probabilities for the context %q for %d positions", len(row), context, len(d.Positions))
+		}
+	}
+
+	return nil
+
+}
+
+// GibberishBundle holds several models, one per language
+// or domain. An input is a word if any of the models
+// accepts it, each with its own threshold.
+type GibberishBundle struct {
+	// Models are the models of the bundle, keyed by their
+	// language or domain.
+	Models map[string]*GibberishData
+}
+
+// Validate checks that the bundle has at least one model and
+// that all its models are consistent.
+func (b *GibberishBundle) Validate() error {
+
+	if len(b.Models) == 0 {
+		return fmt.Errorf("Validate: the bundle has no models")
+	}
+
+	for language, data := range b.Models {
+		if data == nil {
+			return fmt.Errorf("Validate: the model %q is nil", language)
+		}
+		if err := data.Validate(); err != nil {
+			return fmt.Errorf("Validate: invalid model %q: %w", language, err)
+		}
+	}
+
+	return nil
+
 }
@@ -0,0 +1,288 @@
+package training
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grafana/clusterurl/pkg/analysis"
+)
+
+// Objective is the criterion used to pick the threshold of a
+// model from its scores on the good and bad inputs.
+type Objective string
+
+const (
+	// ObjectiveMidpoint picks the threshold halfway between the
+	// worst good and the best bad inputs, or falls back to
+	// ObjectiveF1 if they overlap. This is the default.
+	ObjectiveMidpoint Objective = "midpoint"
+	// ObjectiveF1 picks the threshold maximising the F1 score.
+	ObjectiveF1 Objective = "f1"
+	// ObjectivePrecision picks the threshold with the best
+	// recall among the ones reaching the target precision.
+	ObjectivePrecision Objective = "precision"
+	// ObjectiveRecall picks the threshold with the best
+	// precision among the ones reaching the target recall.
+	ObjectiveRecall Objective = "recall"
+)
+
+// OperatingPoint describes how a threshold classifies the
+// good and bad inputs. Gibberish is the positive class: an
+// input is predicted to be gibberish when its probability is
+// at or under the threshold.
+type OperatingPoint struct {
+	Threshold float64 `json:"threshold"`
+	// TruePositives is the number of bad inputs found
+	// gibberish.
+	TruePositives int `json:"true_positives"`
+	// FalsePositives is the number of good inputs found
+	// gibberish.
+	FalsePositives int `json:"false_positives"`
+	// TrueNegatives is the number of good inputs accepted.
+	TrueNegatives int `json:"true_negatives"`
+	// FalseNegatives is the number of bad inputs accepted.
+	FalseNegatives int `json:"false_negatives"`
+	// TruePositiveRate is the share of bad inputs found
+	// gibberish, also known as the recall.
+	TruePositiveRate float64 `json:"true_positive_rate"`
+	// FalsePositiveRate is the share of good inputs found
+	// gibberish.
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+	// Precision is the share of inputs found gibberish that
+	// are bad. It is 1 when no input is found gibberish.
+	Precision float64 `json:"precision"`
+	F1        float64 `json:"f1"`
+}
+
+// Report describes how the threshold of a model was picked.
+type Report struct {
+	Objective Objective `json:"objective"`
+	// Target is the precision or recall to reach, if any.
+	Target float64 `json:"target,omitempty"`
+	// Good and Bad are the number of good and bad inputs.
+	Good int `json:"good"`
+	Bad  int `json:"bad"`
+	// Chosen is the operating point of the picked threshold,
+	// including its confusion matrix.
+	Chosen OperatingPoint `json:"chosen"`
+	// Curve is the ROC curve, from the lowest threshold to the
+	// highest one.
+	Curve []OperatingPoint `json:"roc"`
+	// AUC is the area under the ROC curve.
+	AUC float64 `json:"auc"`
+}
+
+// selectThreshold picks the threshold separating the
+// probabilities of the good and bad inputs according to the
+// objective, and reports how it was picked.
+func selectThreshold(good, bad []float64, objective Objective, target float64) (*Report, error) {
+
+	if len(good) == 0 || len(bad) == 0 {
+		return nil, fmt.Errorf("selectThreshold: good and bad inputs are both needed")
+	}
+
+	report := Report{
+		Objective: objective,
+		Good:      len(good),
+		Bad:       len(bad),
+		Curve:     rocCurve(good, bad),
+	}
+	report.AUC = areaUnderCurve(report.Curve)
+
+	switch objective {
+	case "", ObjectiveMidpoint:
+		report.Objective = ObjectiveMidpoint
+
+		minimumGoodProbability := analysis.MinForSlice(good)
+		maximumBadProbability := analysis.MaxForSlice(bad)
+
+		// Pick a threshold halfway between the worst good and best
+		// bad inputs, unless they overlap, in which case no threshold
+		// separates them and the one maximising the F1 score is
+		// picked instead.
+		if minimumGoodProbability > maximumBadProbability {
+			report.Chosen = operatingPoint((minimumGoodProbability+maximumBadProbability)/2, good, bad)
+			return &report, nil
+		}
+		objective = ObjectiveF1
+		report.Objective = ObjectiveF1
+	case ObjectiveF1:
+	case ObjectivePrecision, ObjectiveRecall:
+		if target <= 0 || target > 1 {
+			return nil, fmt.Errorf("selectThreshold: the target %v is not between 0 and 1", target)
+		}
+		report.Target = target
+	default:
+		return nil, fmt.Errorf("selectThreshold: unknown objective %q", objective)
+	}
+
+	// The points are sorted by increasing threshold, so that
+	// ties go to the lowest threshold, which rejects the fewest
+	// good inputs.
+	best := -1
+	for i, point := range report.Curve {
+
+		if !meetsTarget(point, objective, target) {
+			continue
+		}
+		if best < 0 || better(point, report.Curve[best], objective) {
+			best = i
+		}
+
+	}
+
+	if best < 0 {
+		return nil, fmt.Errorf("selectThreshold: no threshold reaches a %s of %v", objective, target)
+	}
+
+	report.Chosen = report.Curve[best]
+	return &report, nil
+
+}
+
+func meetsTarget(point OperatingPoint, objective Objective, target float64) bool {
+
+	switch objective {
+	case ObjectivePrecision:
+		return point.Precision >= target && point.TruePositives > 0
+	case ObjectiveRecall:
+		return point.TruePositiveRate >= target
+	}
+
+	return true
+
+}
+
+func better(a, b OperatingPoint, objective Objective) bool {
+
+	switch objective {
+	case ObjectivePrecision:
+		return a.TruePositiveRate > b.TruePositiveRate
+	case ObjectiveRecall:
+		return a.Precision > b.Precision
+	}
+
+	return a.F1 > b.F1
+
+}
+
+// rocCurve evaluates the thresholds halfway between each pair
+// of consecutive distinct probabilities, plus one under all of
+// them and one at the highest.
+func rocCurve(good, bad []float64) []OperatingPoint {
+
+	probabilities := make([]float64, 0, len(good)+len(bad))
+	probabilities = append(probabilities, good...)
+	probabilities = append(probabilities, bad...)
+	sort.Float64s(probabilities)
+
+	// The first threshold is just under the lowest probability,
+	// so that no input is found gibberish, even if it is zero.
+	thresholds := []float64{math.Nextafter(probabilities[0], math.Inf(-1))}
+	for i := 1; i < len(probabilities); i++ {
+		if probabilities[i] != probabilities[i-1] {
+			thresholds = append(thresholds, (probabilities[i]+probabilities[i-1])/2)
+		}
+	}
+	thresholds = append(thresholds, probabilities[len(probabilities)-1])
+
+	curve := make([]OperatingPoint, 0, len(thresholds))
+	for _, threshold := range thresholds {
+		curve = append(curve, operatingPoint(threshold, good, bad))
+	}
+
+	return curve
+
+}
+
+func operatingPoint(threshold float64, good, bad []float64) OperatingPoint {
+
+	point := OperatingPoint{Threshold: threshold}
+	for _, probability := range bad {
+		if probability <= threshold {
+			point.TruePositives++
+		} else {
+			point.FalseNegatives++
+		}
+	}
+	for _, probability := range good {
+		if probability <= threshold {
+			point.FalsePositives++
+		} else {
+			point.TrueNegatives++
+		}
+	}
+
+	point.TruePositiveRate = float64(point.TruePositives) / float64(len(bad))
+	point.FalsePositiveRate = float64(point.FalsePositives) / float64(len(good))
+
+	point.Precision = 1
+	if predicted := point.TruePositives + point.FalsePositives; predicted > 0 {
+		point.Precision = float64(point.TruePositives) / float64(predicted)
+	}
+
+	if point.TruePositives > 0 {
+		point.F1 = 2 * point.Precision * point.TruePositiveRate / (point.Precision + point.TruePositiveRate)
+	}
+
+	return point
+
+}
+
+// areaUnderCurve integrates the ROC curve with the trapezoidal
+// rule.
+func areaUnderCurve(curve []OperatingPoint) float64 {
+
+	area := 0.
+	for i := 1; i < len(curve); i++ {
+		width := curve[i].FalsePositiveRate - curve[i-1].FalsePositiveRate
+		area += width * (curve[i].TruePositiveRate + curve[i-1].TruePositiveRate) / 2
+	}
+
+	return math.Abs(area)
+
+}
+
+// reportFileName returns the file the report of a model goes
+// to, next to the file the model is written to. The language
+// tells apart the reports of the models of a bundle, even when
+// they share the same report file.
+func reportFileName(options Options, outputFileName, language string) string {
+
+	if options.ReportFile != "" {
+		if language == "" {
+			return options.ReportFile
+		}
+		ext := filepath.Ext(options.ReportFile)
+		return strings.TrimSuffix(options.ReportFile, ext) + "." + language + ext
+	}
+
+	name := strings.TrimSuffix(outputFileName, ".json")
+	if language != "" {
+		name += "." + language
+	}
+
+	return name + ".report.json"
+
+}
+
+func writeReport(report *Report, fileName string) error {
+
+	toWrite, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeReport: unable to marshal the report: %s", err)
+	}
+
+	err = os.WriteFile(fileName, toWrite, 0644)
+	if err != nil {
+		return fmt.Errorf("writeReport: unable to save the report on disk: %s", err)
+	}
+
+	return nil
+
+}
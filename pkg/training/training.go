@@ -16,25 +16,148 @@ import (
 	"os"
 
 	"github.com/grafana/clusterurl/pkg/analysis"
+	"github.com/grafana/clusterurl/pkg/consts"
 	"github.com/grafana/clusterurl/pkg/persistence"
 	"github.com/grafana/clusterurl/pkg/structs"
 )
 
+// Options configures the training of a model.
+type Options struct {
+	// AcceptedChars are the characters known by the model,
+	// saved with it as its alphabet. They must be lowercase.
+	// Defaults to consts.AcceptedCharacters.
+	AcceptedChars string
+	// TrainingFile is a big file of real text, from which the
+	// probabilities are learned.
+	TrainingFile string
+	// GoodFile holds inputs that are not gibberish, one per
+	// line, used to pick the threshold.
+	GoodFile string
+	// BadFile holds inputs that are gibberish, one per line,
+	// used to pick the threshold.
+	BadFile string
+	// OutputFile is the file the model is written to.
+	OutputFile string
+	// Order is the length of the n-grams of the model.
+	// Defaults to 2.
+	Order int
+	// MinContextCount is the number of times a context of
+	// more than one rune must be seen in the training file to
+	// be kept in the model. Rarer contexts back off to shorter
+	// ones. Defaults to 100.
+	MinContextCount int
+	// Objective is the criterion used to pick the threshold.
+	// Defaults to ObjectiveMidpoint.
+	Objective Objective
+	// Target is the precision or recall to reach with
+	// ObjectivePrecision and ObjectiveRecall, between 0 and 1.
+	Target float64
+	// ReportFile is the file the training report is written
+	// to. Defaults to the output file with a ".report.json"
+	// extension.
+	ReportFile string
+}
+
 // TrainModel computes the probabilities of having a certain
 // digraph by reading a big file.
 func TrainModel(acceptedChars, trainingFileName, goodFileName, badFileName, outputFileName string) error {
 
-	position := getRunePosition(acceptedChars)
+	return TrainModelWithOptions(Options{
+		AcceptedChars: acceptedChars,
+		TrainingFile:  trainingFileName,
+		GoodFile:      goodFileName,
+		BadFile:       badFileName,
+		OutputFile:    outputFileName,
+	})
+
+}
+
+// TrainModelWithOptions computes the probabilities of having
+// a certain n-gram by reading a big file.
+func TrainModelWithOptions(options Options) error {
+
+	data, report, err := trainModel(options)
+	if err != nil {
+		return fmt.Errorf("TrainModelWithOptions: %s", err)
+	}
+
+	err = writeReport(report, reportFileName(options, options.OutputFile, ""))
+	if err != nil {
+		return fmt.Errorf("TrainModelWithOptions: %s", err)
+	}
+
+	err = persistence.WriteKnowledgeBase(data, options.OutputFile)
+	return err
+
+}
+
+// TrainBundle trains one model per language, each from its
+// own corpus, and writes them as a bundle to outputFileName.
+// The output file of the options is ignored, and the language
+// is inserted before the extension of their report file, so
+// that languages sharing one do not overwrite each other.
+func TrainBundle(languages map[string]Options, outputFileName string) error {
+
+	bundle := structs.GibberishBundle{Models: make(map[string]*structs.GibberishData, len(languages))}
+	for language, options := range languages {
+
+		data, report, err := trainModel(options)
+		if err != nil {
+			return fmt.Errorf("TrainBundle: unable to train the model %q: %s", language, err)
+		}
+		bundle.Models[language] = data
+
+		err = writeReport(report, reportFileName(options, outputFileName, language))
+		if err != nil {
+			return fmt.Errorf("TrainBundle: %s", err)
+		}
+
+	}
+
+	err := bundle.Validate()
+	if err != nil {
+		return fmt.Errorf("TrainBundle: invalid bundle: %s", err)
+	}
+
+	err = persistence.WriteBundle(&bundle, outputFileName)
+	return err
+
+}
+
+func trainModel(options Options) (*structs.GibberishData, *Report, error) {
+
+	order := options.Order
+	if order == 0 {
+		order = 2
+	}
+	if order < 2 {
+		return nil, nil, fmt.Errorf("trainModel: invalid order %d", order)
+	}
+
+	minContextCount := options.MinContextCount
+	if minContextCount == 0 {
+		minContextCount = 100
+	}
+
+	alphabet := options.AcceptedChars
+	if alphabet == "" {
+		alphabet = consts.AcceptedCharacters
+	}
+	position := getRunePosition(alphabet)
 
 	// Assume we have seen 10 of each character pair.  This acts as a kind of
 	// prior or smoothing factor.  This way, if we see a character transition
 	// live that we've never observed in the past, we won't assume the entire
 	// string has 0 probability.
-	occurrences := initializeOccurrencesMatrix(len(acceptedChars))
+	occurrences := initializeOccurrencesMatrix(len(position))
+
+	// contexts counts the runes following contexts of more
+	// than one rune, for models of order 3 or more.
+	contexts := map[string][]float64{}
 
-	trainingFile, err := os.Open(trainingFileName)
+	trainingFile, err := os.Open(options.TrainingFile)
 	if err != nil {
-		return fmt.Errorf("TrainModel: unable to open training file %s", trainingFileName)
+		return nil, nil, fmt.Errorf("trainModel: unable to open training file %s", options.TrainingFile)
 	}
 
 	// Count the occurrences of rune pairs by reading a big file.
@@ -46,22 +169,26 @@ func TrainModel(acceptedChars, trainingFileName, goodFileName, badFileName, outp
 			break
 		}
 
-		for _, pair := range analysis.GetDigraphs(string(line)) {
+		for _, pair := range analysis.GetAlphabetDigraphs(string(line), alphabet) {
 
 			firstPosition, firstRuneFound := position[pair.First]
 			if !firstRuneFound {
-				return fmt.Errorf("TrainModel: unable to find the position of the rune %s", string(pair.First))
+				return nil, nil, fmt.Errorf("trainModel: unable to find the position of the rune %s", string(pair.First))
 			}
 
 			secondPosition, secondRuneFound := position[pair.Second]
 			if !secondRuneFound {
-				return fmt.Errorf("TrainModel: unable to find the position of the rune %s", string(pair.First))
+				return nil, nil, fmt.Errorf("trainModel: unable to find the position of the rune %s", string(pair.First))
 			}
 
 			occurrences[firstPosition][secondPosition]++
 
 		}
 
+		if order > 2 {
+			countContexts(contexts, analysis.NormalizeAlphabet(string(line), alphabet), order, position)
+		}
+
 	}
 	_ = trainingFile.Close()
 
@@ -72,40 +199,47 @@ func TrainModel(acceptedChars, trainingFileName, goodFileName, badFileName, outp
 	// http://squarecog.wordpress.com/2009/01/10/dealing-with-underflow-in-joint-probability-calculations/
 	normalizeOccurrencesMatrix(occurrences)
 
-	// Find the probability of generating a few arbitrarily chosen good and bad phrases.
-	goodProbabilities, err := averageTransitionProbabilitiesInFile(goodFileName, occurrences, position)
+	data := structs.GibberishData{
+		Occurrences: occurrences,
+		Positions:   position,
+		Alphabet:    alphabet,
+	}
+	err = data.Validate()
 	if err != nil {
-		return fmt.Errorf("TrainModel: error when computing good probabilities: %s", err)
+		return nil, nil, fmt.Errorf("trainModel: invalid alphabet: %s", err)
+	}
+	if order > 2 {
+		data.Order = order
+		data.Contexts = normalizeContexts(contexts, occurrences, position, float64(minContextCount))
 	}
 
-	badProbabilities, err := averageTransitionProbabilitiesInFile(badFileName, occurrences, position)
+	// Find the probability of generating a few arbitrarily chosen good and bad phrases.
+	var deviations spread
+	goodProbabilities, err := averageTransitionProbabilitiesInFile(options.GoodFile, &data, &deviations)
 	if err != nil {
-		return fmt.Errorf("TrainModel: error when computing bad probabilities: %s", err)
+		return nil, nil, fmt.Errorf("trainModel: error when computing good probabilities: %s", err)
 	}
 
-	minimumGoodProbability := analysis.MinForSlice(goodProbabilities)
-	maximumBadProbability := analysis.MaxForSlice(badProbabilities)
-
-	// Make sure we are actually capable of detecting the junk.
-	if minimumGoodProbability <= maximumBadProbability {
-		return fmt.Errorf("TrainModel: minimumGoodProbability <= maximumBadProbability")
+	badProbabilities, err := averageTransitionProbabilitiesInFile(options.BadFile, &data, &deviations)
+	if err != nil {
+		return nil, nil, fmt.Errorf("trainModel: error when computing bad probabilities: %s", err)
 	}
+	data.Spread = deviations.value()
 
-	// Pick a threshold halfway between the worst good and best bad inputs.
-	threshold := (minimumGoodProbability + maximumBadProbability) / 2
-
-	data := structs.GibberishData{
-		Occurrences: occurrences,
-		Positions:   position,
-		Threshold:   threshold,
+	report, err := selectThreshold(goodProbabilities, badProbabilities, options.Objective, options.Target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("trainModel: unable to pick the threshold: %s", err)
 	}
+	data.Threshold = report.Chosen.Threshold
 
-	err = persistence.WriteKnowledgeBase(&data, outputFileName)
-	return err
+	return &data, report, nil
 
 }
 
-func averageTransitionProbabilitiesInFile(fileName string, occurrences [][]float64, position map[rune]int) ([]float64, error) {
+// averageTransitionProbabilitiesInFile returns the average
+// transition probability of each line of the file, and adds
+// the deviations of their transitions to deviations.
+func averageTransitionProbabilitiesInFile(fileName string, data *structs.GibberishData, deviations *spread) ([]float64, error) {
 
 	res := make([]float64, 0, 5)
 
@@ -122,12 +256,12 @@ func averageTransitionProbabilitiesInFile(fileName string, occurrences [][]float
 			break
 		}
 
-		avgProb, err := analysis.AverageTransitionProbability(string(line), occurrences, position)
+		logProbs, err := analysis.NGramLogProbabilities(string(line), data)
 		if err != nil {
 			break
 		}
 
-		res = append(res, avgProb)
+		res = append(res, math.Exp(deviations.add(logProbs)))
 
 	}
 
@@ -136,11 +270,55 @@ func averageTransitionProbabilitiesInFile(fileName string, occurrences [][]float
 
 }
 
+// spread measures how much the log probabilities of the
+// transitions of an input vary around their average. The
+// confidence of the scores depends on it, since the average
+// of a short input is less reliable when they vary a lot.
+type spread struct {
+	squares float64
+	degrees int
+}
+
+// add adds the deviations of the log probabilities of an
+// input, and returns their average.
+func (s *spread) add(logProbs []float64) float64 {
+
+	if len(logProbs) == 0 {
+		return 0
+	}
+
+	mean := 0.
+	for _, logProb := range logProbs {
+		mean += logProb
+	}
+	mean /= float64(len(logProbs))
+
+	for _, logProb := range logProbs {
+		s.squares += (logProb - mean) * (logProb - mean)
+	}
+	s.degrees += len(logProbs) - 1
+
+	return mean
+
+}
+
+// value returns the pooled standard deviation of the log
+// probabilities, or zero if no input had two transitions.
+func (s *spread) value() float64 {
+
+	if s.degrees == 0 {
+		return 0
+	}
+
+	return math.Sqrt(s.squares / float64(s.degrees))
+
+}
+
 func getRunePosition(characters string) map[rune]int {
 
 	position := make(map[rune]int)
-	for index, currentRune := range characters {
-		position[currentRune] = index
+	for _, currentRune := range characters {
+		position[currentRune] = len(position)
 	}
 
 	return position
@@ -178,3 +356,90 @@ func normalizeOccurrencesMatrix(occurrences [][]float64) {
 	}
 
 }
+
+// countContexts counts, for each rune of the line, the
+// contexts of 2 to order-1 runes preceding it.
+func countContexts(contexts map[string][]float64, runes []rune, order int, position map[rune]int) {
+
+	for i := 2; i < len(runes); i++ {
+
+		for length := 2; length < order && length <= i; length++ {
+
+			context := string(runes[i-length : i])
+			row, found := contexts[context]
+			if !found {
+				row = make([]float64, len(position))
+				contexts[context] = row
+			}
+			row[position[runes[i]]]++
+
+		}
+
+	}
+
+}
+
+// normalizeContexts turns the counts of the contexts seen at
+// least minCount times into log probabilities. The counts are
+// smoothed with the probabilities of the context one rune
+// shorter, with the same weight as the prior of the digraphs,
+// so that rare transitions fall back to what shorter contexts
+// know about them.
+func normalizeContexts(counts map[string][]float64, occurrences [][]float64, position map[rune]int, minCount float64) map[string][]float64 {
+
+	prior := 10 * float64(len(position))
+	contexts := make(map[string][]float64)
+
+	// Shorter contexts are normalized first, since longer ones
+	// are smoothed with them.
+	for length := 2; ; length++ {
+
+		found := false
+		for context, row := range counts {
+
+			runes := []rune(context)
+			if len(runes) != length {
+				continue
+			}
+			found = true
+
+			sum := 0.
+			for _, count := range row {
+				sum += count
+			}
+			if sum < minCount {
+				continue
+			}
+
+			shorter := backoffRow(runes[1:], contexts, occurrences, position)
+			probabilities := make([]float64, len(row))
+			for i, count := range row {
+				probabilities[i] = math.Log((count + prior*math.Exp(shorter[i])) / (sum + prior))
+			}
+			contexts[context] = probabilities
+
+		}
+
+		if !found {
+			break
+		}
+
+	}
+
+	return contexts
+
+}
+
+// backoffRow returns the log probabilities of the runes
+// following the longest known suffix of the context.
+func backoffRow(context []rune, contexts map[string][]float64, occurrences [][]float64, position map[rune]int) []float64 {
+
+	for ; len(context) >= 2; context = context[1:] {
+		if row, found := contexts[string(context)]; found {
+			return row
+		}
+	}
+
+	return occurrences[position[context[0]]]
+
+}
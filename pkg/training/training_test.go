@@ -0,0 +1,261 @@
+package training
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/clusterurl/pkg/analysis"
+	"github.com/grafana/clusterurl/pkg/consts"
+	"github.com/grafana/clusterurl/pkg/gibberish"
+	"github.com/grafana/clusterurl/pkg/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+// trainingOptions writes a small corpus with its good and bad inputs, and
+// returns the options training a model from them.
+func trainingOptions(t *testing.T) Options {
+	dir := t.TempDir()
+	corpus := strings.Repeat("the quick brown fox jumps over the lazy dog while the users of the shop search for products and orders v1 v2 oauth2 k8s\n", 200)
+	files := map[string]string{
+		"big.txt":  corpus,
+		"good.txt": "the brown fox\nsearch products\n",
+		"bad.txt":  "zxcvwerjasc\nqwpzxkjhgf\n",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	return Options{
+		AcceptedChars: consts.AcceptedCharacters,
+		TrainingFile:  filepath.Join(dir, "big.txt"),
+		GoodFile:      filepath.Join(dir, "good.txt"),
+		BadFile:       filepath.Join(dir, "bad.txt"),
+		OutputFile:    filepath.Join(dir, "model.json"),
+	}
+}
+
+func TestNGramModel(t *testing.T) {
+	options := trainingOptions(t)
+	dir := filepath.Dir(options.OutputFile)
+
+	// Bigram models are written and loaded as before.
+	assert.NoError(t, TrainModel(options.AcceptedChars, options.TrainingFile, options.GoodFile, options.BadFile, options.OutputFile))
+	bigram, err := persistence.LoadKnowledgeBase(options.OutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, bigram.Order)
+	assert.Greater(t, bigram.Spread, 0.0)
+	assert.Equal(t, 2, bigram.NGramOrder())
+	assert.Empty(t, bigram.Contexts)
+	content, err := os.ReadFile(options.OutputFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "Order")
+
+	options.Order = 3
+	options.OutputFile = filepath.Join(dir, "trigram.json")
+	assert.NoError(t, TrainModelWithOptions(options))
+	trigram, err := persistence.LoadKnowledgeBase(options.OutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, trigram.Order)
+	assert.Contains(t, trigram.Contexts, "th")
+	assert.NotContains(t, trigram.Contexts, "zx")
+
+	// Unknown contexts back off to the digraphs.
+	digraphs := *trigram
+	digraphs.Order, digraphs.Contexts = 0, nil
+	p, n, err := analysis.AverageNGramProbability("zq", trigram)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	expected, _, err := analysis.AverageNGramProbability("zq", &digraphs)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, p)
+
+	// The longer context makes the words of the corpus more likely.
+	p, n, err = analysis.AverageNGramProbability("the shop", trigram)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	expected, _, err = analysis.AverageNGramProbability("the shop", bigram)
+	assert.NoError(t, err)
+	assert.Greater(t, p, expected)
+	logProbs, err := analysis.NGramLogProbabilities("the shop", trigram)
+	assert.NoError(t, err)
+	assert.Len(t, logProbs, 7)
+
+	trigram.Contexts["the"] = trigram.Contexts["th"]
+	assert.Error(t, trigram.Validate())
+
+	options.Order = 1
+	assert.Error(t, TrainModelWithOptions(options))
+}
+
+func TestModelAlphabet(t *testing.T) {
+	options := trainingOptions(t)
+	options.AcceptedChars = "abcdefghijklmnopqrstuvwxyz0123456789 "
+	assert.NoError(t, TrainModelWithOptions(options))
+	model, err := persistence.LoadKnowledgeBase(options.OutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, options.AcceptedChars, model.Alphabet)
+	assert.Equal(t, 29, model.Positions['3'])
+
+	// Inputs are normalized with the alphabet of the model.
+	assert.Equal(t, 5, gibberish.Score("oauth2", model).Digraphs)
+	assert.NoError(t, gibberish.Score("oauth2", model).Err)
+	assert.Equal(t, []rune("oauth2"), analysis.NormalizeAlphabet("OAuth2!", model.AcceptedCharacters()))
+	assert.Len(t, analysis.GetAlphabetDigraphs("oauth2", model.AcceptedCharacters()), 5)
+
+	options.AcceptedChars = "ABC"
+	assert.Error(t, TrainModelWithOptions(options))
+
+	// The alphabet must match the positions.
+	model.Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz "
+	assert.Error(t, model.Validate())
+	model.Alphabet = ""
+	assert.Error(t, model.Validate())
+}
+
+func TestTrainBundle(t *testing.T) {
+	english := trainingOptions(t)
+	spanish := trainingOptions(t)
+	corpus := strings.Repeat("el rapido zorro marron salta sobre el perro perezoso mientras los usuarios de la tienda buscan productos y pedidos\n", 200)
+	assert.NoError(t, os.WriteFile(spanish.TrainingFile, []byte(corpus), 0o644))
+	assert.NoError(t, os.WriteFile(spanish.GoodFile, []byte("el perro\nbuscan productos\n"), 0o644))
+
+	// Languages sharing a report file each get their own.
+	dir := t.TempDir()
+	english.ReportFile = filepath.Join(dir, "report.json")
+	spanish.ReportFile = english.ReportFile
+	output := filepath.Join(dir, "bundle.json")
+	assert.NoError(t, TrainBundle(map[string]Options{"en": english, "es": spanish}, output))
+	assert.FileExists(t, filepath.Join(dir, "report.en.json"))
+	assert.FileExists(t, filepath.Join(dir, "report.es.json"))
+	assert.NoFileExists(t, english.ReportFile)
+
+	bundle, err := persistence.LoadBundle(output)
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Models, 2)
+
+	language, score := gibberish.ScoreBundle("usuarios", bundle)
+	assert.Equal(t, "es", language)
+	assert.False(t, score.Gibberish())
+	assert.True(t, gibberish.Score("usuarios", bundle.Models["en"]).Gibberish())
+
+	// Single models are loaded as bundles too.
+	_, err = persistence.LoadBundle(english.TrainingFile)
+	assert.Error(t, err)
+	english.ReportFile = ""
+	assert.NoError(t, TrainModelWithOptions(english))
+	bundle, err = persistence.LoadBundle(english.OutputFile)
+	assert.NoError(t, err)
+	assert.Contains(t, bundle.Models, "")
+}
+
+func TestROCCurve(t *testing.T) {
+	good := []float64{0.5, 0.3}
+	bad := []float64{0.01, 0.02, 0.05, 0.4}
+
+	curve := rocCurve(good, bad)
+	assert.Len(t, curve, 7)
+	assert.Equal(t, OperatingPoint{Threshold: math.Nextafter(0.01, 0), FalseNegatives: 4, TrueNegatives: 2, Precision: 1}, curve[0])
+	assert.InDelta(t, 0.175, curve[3].Threshold, 1e-9)
+	assert.Equal(t, 3, curve[3].TruePositives)
+	assert.Equal(t, 0, curve[3].FalsePositives)
+	assert.Equal(t, OperatingPoint{
+		Threshold:         0.5,
+		TruePositives:     4,
+		FalsePositives:    2,
+		TruePositiveRate:  1,
+		FalsePositiveRate: 1,
+		Precision:         4.0 / 6,
+		F1:                0.8,
+	}, curve[6])
+	assert.InDelta(t, 0.875, areaUnderCurve(curve), 1e-9)
+
+	// The curve starts with no input found gibberish, even when the
+	// lowest probability is zero.
+	curve = rocCurve([]float64{0.5}, []float64{0, 0.1})
+	assert.Less(t, curve[0].Threshold, 0.0)
+	assert.Equal(t, 0, curve[0].TruePositives)
+	assert.Equal(t, 0, curve[0].FalsePositives)
+	assert.Equal(t, 1.0, areaUnderCurve(curve))
+}
+
+func TestSelectThreshold(t *testing.T) {
+	good := []float64{0.5, 0.3}
+	bad := []float64{0.01, 0.02, 0.05, 0.4}
+
+	// A good-looking input among the bad ones makes the sets overlap,
+	// and the midpoint falls back to the best F1 score.
+	report, err := selectThreshold(good, bad, ObjectiveMidpoint, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectiveF1, report.Objective)
+	assert.InDelta(t, 0.45, report.Chosen.Threshold, 1e-9)
+	report, err = selectThreshold(good, bad[:3], "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectiveMidpoint, report.Objective)
+	assert.InDelta(t, 0.175, report.Chosen.Threshold, 1e-9)
+	assert.Equal(t, 1.0, report.AUC)
+
+	report, err = selectThreshold(good, bad, ObjectiveF1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Good)
+	assert.Equal(t, 4, report.Bad)
+	assert.Equal(t, OperatingPoint{
+		Threshold:         report.Chosen.Threshold,
+		TruePositives:     4,
+		FalsePositives:    1,
+		TrueNegatives:     1,
+		TruePositiveRate:  1,
+		FalsePositiveRate: 0.5,
+		Precision:         0.8,
+		F1:                report.Chosen.F1,
+	}, report.Chosen)
+	assert.InDelta(t, 0.45, report.Chosen.Threshold, 1e-9)
+	assert.InDelta(t, 8.0/9, report.Chosen.F1, 1e-9)
+
+	// Rejecting no good input costs missing a bad one.
+	report, err = selectThreshold(good, bad, ObjectivePrecision, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, report.Target)
+	assert.Equal(t, 3, report.Chosen.TruePositives)
+	assert.Equal(t, 0, report.Chosen.FalsePositives)
+
+	// Finding every bad input costs rejecting a good one.
+	report, err = selectThreshold(good, bad, ObjectiveRecall, 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.45, report.Chosen.Threshold, 1e-9)
+
+	_, err = selectThreshold(good, bad, ObjectiveRecall, 1.5)
+	assert.Error(t, err)
+	_, err = selectThreshold(good, bad, "accuracy", 0)
+	assert.Error(t, err)
+	_, err = selectThreshold(nil, bad, ObjectiveF1, 0)
+	assert.Error(t, err)
+}
+
+func TestThresholdReport(t *testing.T) {
+	options := trainingOptions(t)
+	options.Objective = ObjectiveF1
+	assert.NoError(t, TrainModelWithOptions(options))
+
+	content, err := os.ReadFile(strings.TrimSuffix(options.OutputFile, ".json") + ".report.json")
+	assert.NoError(t, err)
+	var report Report
+	assert.NoError(t, json.Unmarshal(content, &report))
+	assert.Equal(t, ObjectiveF1, report.Objective)
+
+	model, err := persistence.LoadKnowledgeBase(options.OutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, report.Chosen.Threshold, model.Threshold)
+
+	// The report of the default objective is written too.
+	options.Objective = ""
+	options.OutputFile = filepath.Join(t.TempDir(), "model.json")
+	assert.NoError(t, TrainModelWithOptions(options))
+	assert.FileExists(t, strings.TrimSuffix(options.OutputFile, ".json")+".report.json")
+	options.ReportFile = filepath.Join(t.TempDir(), "report.json")
+	assert.NoError(t, TrainModelWithOptions(options))
+	assert.FileExists(t, options.ReportFile)
+}